@@ -0,0 +1,102 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/reddec/layout/internal"
+	"github.com/reddec/layout/internal/ui"
+	"github.com/reddec/layout/internal/ui/nice"
+	"github.com/reddec/layout/internal/ui/simple"
+)
+
+type AddCommand struct {
+	ConfigSource
+	Version    string  `long:"version" env:"VERSION" description:"Override binary version to bypass manifest restriction"`
+	UI         string  `short:"u" long:"ui" env:"UI" description:"UI mode" default:"nice" choice:"nice" choice:"simple"`
+	Debug      bool    `short:"d" long:"debug" env:"DEBUG" description:"Enable debug mode"`
+	AskOnce    bool    `short:"a" long:"ask-once" env:"ASK_ONCE" description:"Do not retry on wrong user input, good for automation"`
+	Git        gitMode `short:"g" long:"git" env:"GIT" description:"Git client. Default value as in config file (auto)"  choice:"auto" choice:"native" choice:"embedded"`
+	HooksLog   string  `long:"hooks-log" env:"HOOKS_LOG" description:"Append hooks output to file. By default temporary file is used and kept only on failure"`
+	NoInput    bool    `long:"no-input" env:"NO_INPUT" description:"Do not ask for confirmation of hooks from untrusted layouts and fail instead"`
+	Restricted bool    `long:"restricted" env:"RESTRICTED" description:"Execute hooks in restricted mode: writes only inside destination and only allowed commands"`
+	Source     string  `short:"s" long:"source" env:"SOURCE" description:"Override layout source (URL, abbreviation or path) stored in project"`
+	Dest       string  `short:"C" long:"dir" env:"DIR" description:"Directory inside generated project. If not set - current dir will be used"`
+	Args       struct {
+		Generator string   `positional-arg-name:"generator" required:"yes" description:"Name of generator defined in layout"`
+		Args      []string `positional-arg-name:"args" description:"Generator arguments"`
+	} `positional-args:"yes"`
+}
+
+func (cmd AddCommand) Execute([]string) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer cancel()
+
+	if cmd.Dest == "" {
+		cmd.Dest, _ = os.Getwd()
+	}
+
+	config, err := LoadConfig(cmd.configFile())
+	if err != nil {
+		return fmt.Errorf("read config %s: %w", cmd.configFile(), err)
+	}
+
+	if overlayConfig, err := LoadConfig(localConfig); err == nil {
+		config = config.Merge(overlayConfig)
+	}
+
+	var display ui.UI = simple.Default()
+	switch cmd.UI {
+	case "nice":
+		display = nice.New()
+	}
+	// little hack to notify UI that we are done
+	go func() {
+		<-ctx.Done()
+		_ = os.Stdin.Close()
+	}()
+
+	mode := config.Git
+	if cmd.Git != "" {
+		mode = cmd.Git
+	}
+
+	return internal.Generate(ctx, internal.GenerateConfig{
+		Config: internal.Config{
+			Source:   cmd.Source,
+			Target:   cmd.Dest,
+			Aliases:  config.Abbreviations,
+			Default:  config.Default,
+			Defaults: config.Values,
+			Display:  display,
+			Debug:    cmd.Debug,
+			Version:  cmd.Version,
+			AskOnce:  cmd.AskOnce,
+			Git:      mode.client(ctx),
+			HooksLog: cmd.HooksLog,
+			Trusted:  config.Trusted,
+			NoInput:  cmd.NoInput,
+			Sandbox:  config.sandbox(cmd.Restricted),
+		},
+		Generator: cmd.Args.Generator,
+		Args:      cmd.Args.Args,
+	})
+}
@@ -17,12 +17,16 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 
+	"github.com/reddec/layout/internal"
+	"github.com/reddec/layout/internal/gitclient"
+
 	"gopkg.in/yaml.v3"
 )
 
@@ -31,6 +35,9 @@ type Config struct {
 	Abbreviations map[string]string      `yaml:"abbreviations,omitempty"` // abbreviations, (ex: alias:owner/repo), stored as alias => pattern ({0} as placeholder)
 	Values        map[string]interface{} `yaml:"values,omitempty"`        // global default values
 	Git           gitMode                `yaml:"git,omitempty"`           // global default (if not defined by flag) git mode: auto (default), native, embedded
+	Trusted       []string               `yaml:"trusted,omitempty"`       // remote layouts (sources, URLs, or URL prefixes ended by / or :) which hooks are executed without confirmation
+	Restricted    bool                   `yaml:"restricted,omitempty"`    // execute hooks in restricted mode
+	Allow         []string               `yaml:"allow,omitempty"`         // external commands allowed for hooks in restricted mode
 }
 
 func LoadConfig(file string) (*Config, error) {
@@ -59,9 +66,20 @@ func (cfg *Config) Merge(other *Config) *Config {
 	if other.Git != "" {
 		cp.Git = other.Git
 	}
+	cp.Trusted = append(append([]string{}, cfg.Trusted...), other.Trusted...)
+	cp.Restricted = cfg.Restricted || other.Restricted
+	cp.Allow = append(append([]string{}, cfg.Allow...), other.Allow...)
 	return &cp
 }
 
+// sandbox for hooks if restricted mode enabled by config or flag, otherwise nil.
+func (cfg *Config) sandbox(restricted bool) *internal.Sandbox {
+	if !cfg.Restricted && !restricted {
+		return nil
+	}
+	return &internal.Sandbox{Allow: cfg.Allow}
+}
+
 func mergeMap[K comparable, V any](src, overlay map[K]V) map[K]V {
 	ans := make(map[K]V, len(src))
 	for k, v := range src {
@@ -113,6 +131,19 @@ var (
 	gitEmbedded gitMode = "embedded"
 )
 
+func (g gitMode) client(ctx context.Context) gitclient.Client {
+	switch g {
+	case gitAuto:
+		return gitclient.Auto(ctx)
+	case gitNative:
+		return gitclient.Native
+	case gitEmbedded:
+		fallthrough
+	default:
+		return gitclient.Embedded
+	}
+}
+
 func (g *gitMode) UnmarshalText(text []byte) error {
 	v := string(text)
 	switch v {
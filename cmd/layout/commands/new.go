@@ -39,8 +39,12 @@ type NewCommand struct {
 	UI             string  `short:"u" long:"ui" env:"UI" description:"UI mode" default:"nice" choice:"nice" choice:"simple"`
 	Debug          bool    `short:"d" long:"debug" env:"DEBUG" description:"Enable debug mode"`
 	AskOnce        bool    `short:"a" long:"ask-once" env:"ASK_ONCE" description:"Do not retry on wrong user input, good for automation"`
-	DisableCleanup bool    `short:"D" long:"disable-cleanup" env:"DISABLE_CLEANUP" description:"Disable removing created dirs in case of failure"`
+	DisableCleanup bool    `short:"D" long:"disable-cleanup" env:"DISABLE_CLEANUP" description:"Do not roll back failed generation, keep generated or backed up files for debugging"`
 	Git            gitMode `short:"g" long:"git" env:"GIT" description:"Git client. Default value as in config file (auto)"  choice:"auto" choice:"native" choice:"embedded"`
+	HooksLog       string  `long:"hooks-log" env:"HOOKS_LOG" description:"Append hooks output to file. By default temporary file is used and kept only on failure"`
+	NoInput        bool    `long:"no-input" env:"NO_INPUT" description:"Do not ask for confirmation of hooks from untrusted layouts and fail instead"`
+	Restricted     bool    `long:"restricted" env:"RESTRICTED" description:"Execute hooks in restricted mode: writes only inside destination and only allowed commands"`
+	GitInit        bool    `long:"git-init" env:"GIT_INIT" description:"Initialize git repository with initial commit after generation"`
 	Args           struct {
 		URL  string `positional-arg-name:"source" description:"URL, abbreviation or path to layout. It could be empty, than default section will be used in config"`
 		Dest string `positional-arg-name:"destination" description:"Destination directory, will be created if not exists. If not set - current dir will be used"`
@@ -75,33 +79,28 @@ func (cmd NewCommand) Execute([]string) error {
 		_ = os.Stdin.Close()
 	}()
 
-	var weCreatedDestination bool
-	if _, err := os.Stat(cmd.Args.Dest); os.IsNotExist(err) {
-		weCreatedDestination = true
-	}
-
 	gitClient := cmd.gitClient(ctx, config.Git)
 	if cmd.Debug {
 		fmt.Println("Git:", runtime.FuncForPC(reflect.ValueOf(gitClient).Pointer()).Name())
 	}
-	err = internal.Deploy(ctx, internal.Config{
-		Source:   cmd.Args.URL,
-		Target:   cmd.Args.Dest,
-		Aliases:  config.Abbreviations,
-		Default:  config.Default,
-		Defaults: config.Values,
-		Display:  display,
-		Debug:    cmd.Debug,
-		Version:  cmd.Version,
-		AskOnce:  cmd.AskOnce,
-		Git:      gitClient,
+	return internal.Deploy(ctx, internal.Config{
+		Source:         cmd.Args.URL,
+		Target:         cmd.Args.Dest,
+		Aliases:        config.Abbreviations,
+		Default:        config.Default,
+		Defaults:       config.Values,
+		Display:        display,
+		Debug:          cmd.Debug,
+		Version:        cmd.Version,
+		AskOnce:        cmd.AskOnce,
+		Git:            gitClient,
+		HooksLog:       cmd.HooksLog,
+		Trusted:        config.Trusted,
+		NoInput:        cmd.NoInput,
+		Sandbox:        config.sandbox(cmd.Restricted),
+		GitInit:        cmd.GitInit,
+		DisableCleanup: cmd.DisableCleanup,
 	})
-
-	if err != nil && weCreatedDestination && !cmd.DisableCleanup {
-		_ = os.RemoveAll(cmd.Args.Dest)
-	}
-
-	return err
 }
 
 func (cmd NewCommand) gitClient(ctx context.Context, preferred gitMode) gitclient.Client {
@@ -109,14 +108,5 @@ func (cmd NewCommand) gitClient(ctx context.Context, preferred gitMode) gitclien
 	if cmd.Git != "" {
 		mode = cmd.Git
 	}
-	switch mode {
-	case "auto":
-		return gitclient.Auto(ctx)
-	case "native":
-		return gitclient.Native
-	case "embedded":
-		fallthrough
-	default:
-		return gitclient.Embedded
-	}
+	return mode.client(ctx)
 }
@@ -0,0 +1,85 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"github.com/reddec/layout/internal"
+)
+
+type TestCommand struct {
+	Version string   `long:"version" env:"VERSION" description:"Override binary version to bypass manifest restriction"`
+	Debug   bool     `short:"d" long:"debug" env:"DEBUG" description:"Enable debug mode"`
+	Update  bool     `short:"U" long:"update" env:"UPDATE" description:"Regenerate golden directories instead of comparing"`
+	Trusted []string `long:"trusted" env:"TRUSTED" env-delim:"," description:"Remote base layout (source, URL or URL prefix ended by / or :) which hooks are allowed, could be repeated"`
+	Yes     bool     `short:"y" long:"yes" env:"YES" description:"Allow hooks of all remote base layouts"`
+	Args    struct {
+		Source string `positional-arg-name:"source" description:"Path to layout or to directory with layouts. If not set - current dir will be used"`
+	} `positional-args:"yes"`
+}
+
+func (cmd TestCommand) Execute([]string) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer cancel()
+
+	if cmd.Args.Source == "" {
+		cmd.Args.Source, _ = os.Getwd()
+	}
+
+	results, err := internal.Test(ctx, internal.TestConfig{
+		Source:  cmd.Args.Source,
+		Update:  cmd.Update,
+		Version: cmd.Version,
+		Debug:   cmd.Debug,
+		Trusted: cmd.Trusted,
+		Yes:     cmd.Yes,
+	})
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, res := range results {
+		name := filepath.Join(res.Layout, internal.TestsDir, res.Name)
+		switch {
+		case res.Err != nil:
+			failed++
+			fmt.Println("FAIL", name)
+			fmt.Println("    ", res.Err)
+		case len(res.Differences) > 0:
+			failed++
+			fmt.Println("FAIL", name)
+			for _, diff := range res.Differences {
+				fmt.Println(diff)
+			}
+		case cmd.Update:
+			fmt.Println("UPDATED", name)
+		default:
+			fmt.Println("OK", name)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d test cases failed", failed, len(results))
+	}
+	return nil
+}
@@ -37,11 +37,15 @@ type Config struct {
 	New  commands.NewCommand  `command:"new" description:"deploy layout"`
 	Show commands.ShowCommand `command:"show" description:"show configuration"`
 	Set  commands.SetCommand  `command:"set" description:"set configuration"`
+	Test commands.TestCommand `command:"test" description:"test layout against golden directories"`
+	Add  commands.AddCommand  `command:"add" description:"apply layout generator to generated project"`
 }
 
 func main() {
 	var config Config
 	config.New.Version = version
+	config.Test.Version = version
+	config.Add.Version = version
 	parser := flags.NewParser(&config, flags.Default)
 	parser.ShortDescription = "Create new project based on layout"
 	parser.LongDescription = fmt.Sprintf("Create new project based on layout\nlayout %s, commit %s, built at %s by %s\nAuthor: Aleksandr Baryshnikov <owner@reddec.net>", version, commit, date, builtBy)
@@ -0,0 +1,786 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"gopkg.in/yaml.v3"
+)
+
+// names of defined operations.
+func (a Action) defined() []string {
+	var names []string
+	if a.GitInit.enabled() {
+		names = append(names, "git_init")
+	}
+	if len(a.Chmod) > 0 {
+		names = append(names, "chmod")
+	}
+	if len(a.Mkdir) > 0 {
+		names = append(names, "mkdir")
+	}
+	if len(a.Remove) > 0 {
+		names = append(names, "remove")
+	}
+	if a.Move != nil {
+		names = append(names, "move")
+	}
+	if a.Copy != nil {
+		names = append(names, "copy")
+	}
+	if a.Append != nil {
+		names = append(names, "append")
+	}
+	if a.ReplaceInFile != nil {
+		names = append(names, "replace_in_file")
+	}
+	if a.JSONPatch != nil {
+		names = append(names, "json_patch")
+	}
+	if a.YAMLPatch != nil {
+		names = append(names, "yaml_patch")
+	}
+	return names
+}
+
+// describe action with its arguments (paths, patterns, target files) for user confirmation.
+func (a Action) describe() string {
+	names := a.defined()
+	if len(names) != 1 {
+		return "action " + strings.Join(names, ", ")
+	}
+	var args []string
+	switch names[0] {
+	case "git_init":
+		if a.GitInit.Remote != "" {
+			args = append(args, "remote "+strconv.Quote(a.GitInit.Remote))
+		}
+		if a.GitInit.NoCommit {
+			args = append(args, "without commit")
+		}
+	case "chmod":
+		for _, rule := range a.Chmod {
+			args = append(args, fmt.Sprintf("%q %04o", rule.Glob, rule.Mode))
+		}
+	case "mkdir":
+		args = quoteAll(a.Mkdir)
+	case "remove":
+		args = quoteAll(a.Remove)
+	case "move":
+		args = append(args, fmt.Sprintf("%q to %q", a.Move.From, a.Move.To))
+	case "copy":
+		args = append(args, fmt.Sprintf("%q to %q", a.Copy.From, a.Copy.To))
+	case "append":
+		args = append(args, "to "+strconv.Quote(a.Append.File))
+	case "replace_in_file":
+		args = append(args, fmt.Sprintf("%q in %q", a.ReplaceInFile.Pattern, a.ReplaceInFile.File))
+	case "json_patch":
+		args = a.JSONPatch.describe()
+	case "yaml_patch":
+		args = a.YAMLPatch.describe()
+	}
+	if len(args) == 0 {
+		return "action " + names[0]
+	}
+	return "action " + names[0] + " " + strings.Join(args, ", ")
+}
+
+// target file and modified paths of patch.
+func (pa *PatchAction) describe() []string {
+	var keys = make([]string, 0, len(pa.Set))
+	for key := range pa.Set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := []string{strconv.Quote(pa.File)}
+	if len(keys) > 0 {
+		args = append(args, "set "+strings.Join(quoteAll(keys), " "))
+	}
+	if len(pa.Delete) > 0 {
+		args = append(args, "delete "+strings.Join(quoteAll(pa.Delete), " "))
+	}
+	return args
+}
+
+func quoteAll(values []string) []string {
+	var ans = make([]string, 0, len(values))
+	for _, v := range values {
+		ans = append(ans, strconv.Quote(v))
+	}
+	return ans
+}
+
+// apply action in work dir. In restricted mode (sandbox in context) all modified paths should be writable.
+func (a Action) apply(ctx context.Context, workDir string, layoutFS string) error {
+	names := a.defined()
+	if len(names) != 1 {
+		return fmt.Errorf("exactly one action should be defined, got %v", names)
+	}
+	target := func(file string) (string, error) {
+		file = filepath.Join(workDir, filepath.FromSlash(file))
+		if sb := sandboxFrom(ctx); sb != nil && !sb.canWrite(file) {
+			return "", fmt.Errorf("write to %s is not allowed in restricted mode", file)
+		}
+		return file, nil
+	}
+	switch names[0] {
+	case "git_init":
+		dir, err := target(".")
+		if err != nil {
+			return err
+		}
+		return a.GitInit.apply(dir)
+	case "chmod":
+		dir, err := target(".")
+		if err != nil {
+			return err
+		}
+		return a.Chmod.applyDir(dir)
+	case "mkdir":
+		for _, dir := range a.Mkdir {
+			dir, err := target(dir)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "remove":
+		dir, err := target(".")
+		if err != nil {
+			return err
+		}
+		return removeGlobs(dir, a.Remove)
+	case "move":
+		from, err := target(a.Move.From)
+		if err != nil {
+			return err
+		}
+		to, err := target(a.Move.To)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+		return os.Rename(from, to)
+	case "copy":
+		to, err := target(a.Copy.To)
+		if err != nil {
+			return err
+		}
+		return copyPath(filepath.Join(layoutFS, filepath.Clean("/"+filepath.FromSlash(a.Copy.From))), to)
+	case "append":
+		file, err := target(a.Append.File)
+		if err != nil {
+			return err
+		}
+		return appendFile(file, a.Append.Content)
+	case "replace_in_file":
+		file, err := target(a.ReplaceInFile.File)
+		if err != nil {
+			return err
+		}
+		return a.ReplaceInFile.apply(file)
+	case "json_patch":
+		file, err := target(a.JSONPatch.File)
+		if err != nil {
+			return err
+		}
+		return a.JSONPatch.apply(file, true)
+	case "yaml_patch":
+		file, err := target(a.YAMLPatch.File)
+		if err != nil {
+			return err
+		}
+		return a.YAMLPatch.apply(file, false)
+	}
+	return nil
+}
+
+// render templated paths, content and values.
+func (a Action) render(renderer *renderContext) (Action, error) {
+	var err error
+	renderAll := func(values ...*string) {
+		for _, v := range values {
+			if err != nil {
+				return
+			}
+			*v, err = renderer.Render(*v)
+		}
+	}
+	if a.GitInit != nil {
+		cp, err := a.GitInit.render(renderer)
+		if err != nil {
+			return a, err
+		}
+		a.GitInit = &cp
+	}
+	if len(a.Chmod) > 0 {
+		a.Chmod = append(ChmodRules{}, a.Chmod...)
+		for i := range a.Chmod {
+			renderAll(&a.Chmod[i].Glob)
+		}
+	}
+	a.Mkdir = append([]string{}, a.Mkdir...)
+	for i := range a.Mkdir {
+		renderAll(&a.Mkdir[i])
+	}
+	a.Remove = append([]string{}, a.Remove...)
+	for i := range a.Remove {
+		renderAll(&a.Remove[i])
+	}
+	if a.Move != nil {
+		cp := *a.Move
+		renderAll(&cp.From, &cp.To)
+		a.Move = &cp
+	}
+	if a.Copy != nil {
+		cp := *a.Copy
+		renderAll(&cp.From, &cp.To)
+		a.Copy = &cp
+	}
+	if a.Append != nil {
+		cp := *a.Append
+		renderAll(&cp.File, &cp.Content)
+		a.Append = &cp
+	}
+	if a.ReplaceInFile != nil {
+		cp := *a.ReplaceInFile
+		renderAll(&cp.File, &cp.Pattern, &cp.Replace)
+		a.ReplaceInFile = &cp
+	}
+	if err != nil {
+		return a, err
+	}
+	for _, patch := range []**PatchAction{&a.JSONPatch, &a.YAMLPatch} {
+		if *patch == nil {
+			continue
+		}
+		cp, err := (*patch).render(renderer)
+		if err != nil {
+			return a, err
+		}
+		*patch = &cp
+	}
+	return a, nil
+}
+
+// UnmarshalYAML allows defining git init as boolean.
+func (g *GitInitAction) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var enabled bool
+		if err := value.Decode(&enabled); err != nil {
+			return err
+		}
+		*g = GitInitAction{disabled: !enabled}
+		return nil
+	}
+	type plain GitInitAction
+	return value.Decode((*plain)(g))
+}
+
+func (g *GitInitAction) enabled() bool {
+	return g != nil && !g.disabled
+}
+
+// render templated fields.
+func (g GitInitAction) render(renderer *renderContext) (GitInitAction, error) {
+	for _, v := range []*string{&g.Branch, &g.Remote, &g.Message, &g.Author, &g.Email} {
+		value, err := renderer.Render(*v)
+		if err != nil {
+			return g, err
+		}
+		*v = value
+	}
+	return g, nil
+}
+
+// initialize git repository in directory, add origin remote (if set), and commit all files (except ignored).
+// Author of commit (if not set) is taken from git config (user.name and user.email).
+func (g GitInitAction) apply(dir string) error {
+	branch := g.Branch
+	if branch == "" {
+		branch = "main"
+	}
+	repo, err := git.PlainInitWithOptions(dir, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName(branch)},
+	})
+	if err != nil {
+		return fmt.Errorf("init repository: %w", err)
+	}
+	if g.Remote != "" {
+		_, err = repo.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{g.Remote}})
+		if err != nil {
+			return fmt.Errorf("add remote: %w", err)
+		}
+	}
+	if g.NoCommit {
+		return nil
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("get worktree: %w", err)
+	}
+	if err := worktree.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		return fmt.Errorf("add files: %w", err)
+	}
+	author := &object.Signature{Name: g.Author, Email: g.Email, When: time.Now()}
+	h := helpers{workDir: dir}
+	if author.Name == "" {
+		author.Name, _ = h.gitConfig("user.name")
+	}
+	if author.Email == "" {
+		author.Email, _ = h.gitConfig("user.email")
+	}
+	if author.Name == "" {
+		author.Name = "layout"
+	}
+	if author.Email == "" {
+		author.Email = "layout@localhost"
+	}
+	message := g.Message
+	if message == "" {
+		message = "Initial commit"
+	}
+	_, err = worktree.Commit(message, &git.CommitOptions{Author: author, AllowEmptyCommits: true})
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// apply modes to all files and directories inside directory. Glob matched against path relative to directory.
+func (cr ChmodRules) applyDir(dir string) error {
+	var matchers = make([]*globMatcher, 0, len(cr))
+	for _, rule := range cr {
+		matchers = append(matchers, newGlobMatcher([]string{rule.Glob}))
+	}
+	return filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		for i := len(cr) - 1; i >= 0; i-- {
+			if matchers[i].Match(filepath.ToSlash(relPath), info.IsDir()) {
+				return os.Chmod(path, cr[i].Mode)
+			}
+		}
+		return nil
+	})
+}
+
+// remove files and directories matched by globs (relative to directory).
+func removeGlobs(dir string, globs []string) error {
+	matcher := newGlobMatcher(globs)
+	var matched []string
+	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if !matcher.Match(filepath.ToSlash(relPath), info.IsDir()) {
+			return nil
+		}
+		matched = append(matched, path)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range matched {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy file or directory (recursively) to destination, parent directories will be created.
+func copyPath(src, dest string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		_, err := CopyTree(src, dest)
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := copyFile(src, dest); err != nil {
+		return err
+	}
+	return os.Chmod(dest, info.Mode().Perm())
+}
+
+// append content to the file, file will be created if not exists.
+func appendFile(file string, content string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// replace all matches in file, mode of file is kept.
+func (ra ReplaceAction) apply(file string) error {
+	pattern, err := regexp.Compile(ra.Pattern)
+	if err != nil {
+		return fmt.Errorf("parse pattern: %w", err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return writeFile(file, pattern.ReplaceAll(data, []byte(ra.Replace)), info.Mode())
+}
+
+// render string values (including nested).
+func (pa PatchAction) render(renderer *renderContext) (PatchAction, error) {
+	var err error
+	if pa.File, err = renderer.Render(pa.File); err != nil {
+		return pa, err
+	}
+	set := make(map[string]interface{}, len(pa.Set))
+	for k, v := range pa.Set {
+		if set[k], err = renderValue(renderer, v); err != nil {
+			return pa, fmt.Errorf("render %s: %w", k, err)
+		}
+	}
+	pa.Set = set
+	return pa, nil
+}
+
+func renderValue(renderer *renderContext, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return renderer.Render(v)
+	case []interface{}:
+		var list = make([]interface{}, 0, len(v))
+		for _, item := range v {
+			item, err := renderValue(renderer, item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, nil
+	case map[string]interface{}:
+		var m = make(map[string]interface{}, len(v))
+		for key, item := range v {
+			item, err := renderValue(renderer, item)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = item
+		}
+		return m, nil
+	default:
+		return value, nil
+	}
+}
+
+// patch JSON or YAML file: set values, then delete paths. Order of keys and (for YAML) comments are preserved.
+// Missing file is treated as empty document.
+func (pa PatchAction) apply(file string, asJSON bool) error {
+	var mode os.FileMode = 0644
+	data, err := os.ReadFile(file)
+	if err == nil {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		mode = info.Mode()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("parse %s: %w", file, err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+
+	for _, path := range sortedKeys(keysOf(pa.Set)) {
+		var value yaml.Node
+		if err := value.Encode(pa.Set[path]); err != nil {
+			return fmt.Errorf("encode %s: %w", path, err)
+		}
+		if asJSON {
+			value.Style = 0
+		}
+		if err := setNode(root, strings.Split(path, "."), &value); err != nil {
+			return fmt.Errorf("set %s: %w", path, err)
+		}
+	}
+	for _, path := range pa.Delete {
+		deleteNode(root, strings.Split(path, "."))
+	}
+
+	var out bytes.Buffer
+	if asJSON {
+		if err := writeJSON(&out, root, "", jsonIndent(data)); err != nil {
+			return err
+		}
+		out.WriteString("\n")
+	} else {
+		enc := yaml.NewEncoder(&out)
+		enc.SetIndent(2)
+		if err := enc.Encode(&doc); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+		return os.WriteFile(file, out.Bytes(), mode)
+	}
+	return writeFile(file, out.Bytes(), mode)
+}
+
+func keysOf(m map[string]interface{}) map[string]bool {
+	keys := make(map[string]bool, len(m))
+	for k := range m {
+		keys[k] = true
+	}
+	return keys
+}
+
+// set value by path, missing objects are created. Index equal to length of list appends item.
+func setNode(node *yaml.Node, path []string, value *yaml.Node) error {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		*node = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+	key := path[0]
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value != key {
+				continue
+			}
+			if len(path) == 1 {
+				node.Content[i+1] = keepComments(node.Content[i+1], value)
+				return nil
+			}
+			return setNode(node.Content[i+1], path[1:], value)
+		}
+		child := value
+		if len(path) > 1 {
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			if err := setNode(child, path[1:], value); err != nil {
+				return err
+			}
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, child)
+		return nil
+	case yaml.SequenceNode:
+		idx, err := strconv.Atoi(key)
+		if err != nil || idx < 0 || idx > len(node.Content) {
+			return fmt.Errorf("invalid index %s", key)
+		}
+		if idx == len(node.Content) {
+			child := value
+			if len(path) > 1 {
+				child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+				if err := setNode(child, path[1:], value); err != nil {
+					return err
+				}
+			}
+			node.Content = append(node.Content, child)
+			return nil
+		}
+		if len(path) == 1 {
+			node.Content[idx] = keepComments(node.Content[idx], value)
+			return nil
+		}
+		return setNode(node.Content[idx], path[1:], value)
+	default:
+		return fmt.Errorf("%s is not an object or list", key)
+	}
+}
+
+// copy comments of replaced node to the new one.
+func keepComments(old, value *yaml.Node) *yaml.Node {
+	value.HeadComment, value.LineComment, value.FootComment = old.HeadComment, old.LineComment, old.FootComment
+	return value
+}
+
+// delete value by path, missing path is ignored.
+func deleteNode(node *yaml.Node, path []string) {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	key := path[0]
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value != key {
+				continue
+			}
+			if len(path) == 1 {
+				node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			} else {
+				deleteNode(node.Content[i+1], path[1:])
+			}
+			return
+		}
+	case yaml.SequenceNode:
+		idx, err := strconv.Atoi(key)
+		if err != nil || idx < 0 || idx >= len(node.Content) {
+			return
+		}
+		if len(path) == 1 {
+			node.Content = append(node.Content[:idx], node.Content[idx+1:]...)
+		} else {
+			deleteNode(node.Content[idx], path[1:])
+		}
+	}
+}
+
+// indentation of the first indented line in JSON document, default is two spaces.
+func jsonIndent(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && len(trimmed) < len(line) {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return "  "
+}
+
+// write YAML node as JSON keeping order of keys.
+func writeJSON(out *bytes.Buffer, node *yaml.Node, prefix, indent string) error {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return writeJSON(out, node.Alias, prefix, indent)
+	case yaml.MappingNode:
+		if len(node.Content) == 0 {
+			out.WriteString("{}")
+			return nil
+		}
+		out.WriteString("{\n")
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, _ := json.Marshal(node.Content[i].Value)
+			out.WriteString(prefix + indent)
+			out.Write(key)
+			out.WriteString(": ")
+			if err := writeJSON(out, node.Content[i+1], prefix+indent, indent); err != nil {
+				return err
+			}
+			if i+2 < len(node.Content) {
+				out.WriteString(",")
+			}
+			out.WriteString("\n")
+		}
+		out.WriteString(prefix + "}")
+	case yaml.SequenceNode:
+		if len(node.Content) == 0 {
+			out.WriteString("[]")
+			return nil
+		}
+		out.WriteString("[\n")
+		for i, item := range node.Content {
+			out.WriteString(prefix + indent)
+			if err := writeJSON(out, item, prefix+indent, indent); err != nil {
+				return err
+			}
+			if i+1 < len(node.Content) {
+				out.WriteString(",")
+			}
+			out.WriteString("\n")
+		}
+		out.WriteString(prefix + "]")
+	case yaml.ScalarNode:
+		switch node.Tag {
+		case "!!str":
+			value, _ := json.Marshal(node.Value)
+			out.Write(value)
+			return nil
+		case "!!int", "!!float", "!!bool", "!!null":
+			if json.Valid([]byte(node.Value)) {
+				out.WriteString(node.Value)
+				return nil
+			}
+		}
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		out.Write(data)
+	default:
+		return fmt.Errorf("unsupported node kind %v", node.Kind)
+	}
+	return nil
+}
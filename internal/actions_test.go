@@ -0,0 +1,352 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestActions(t *testing.T) {
+	ctx := context.Background()
+	state := map[string]interface{}{
+		"name":    "demo",
+		"version": "1.2.3",
+	}
+
+	// parse hook from YAML to be sure that inline actions decoded properly
+	runAction := func(t *testing.T, workDir, layoutDir string, spec string) error {
+		var hook Hook
+		require.NoError(t, yaml.Unmarshal([]byte(spec), &hook))
+		return hook.execute(ctx, newRenderContext(state), workDir, layoutDir)
+	}
+
+	t.Run("mkdir, append, move and remove", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, runAction(t, tmpDir, "", `mkdir: ["{{.name}}/a", "{{.name}}/b"]`))
+		require.DirExists(t, filepath.Join(tmpDir, "demo", "a"))
+		require.DirExists(t, filepath.Join(tmpDir, "demo", "b"))
+
+		require.NoError(t, runAction(t, tmpDir, "", `
+append:
+  file: demo/a/notes.txt
+  content: "{{.name}}\n"`))
+		require.NoError(t, runAction(t, tmpDir, "", `
+append:
+  file: demo/a/notes.txt
+  content: "{{.version}}\n"`))
+		requireContent(t, "demo\n1.2.3\n", filepath.Join(tmpDir, "demo", "a", "notes.txt"))
+
+		require.NoError(t, runAction(t, tmpDir, "", `
+move:
+  from: demo/a/notes.txt
+  to: docs/NOTES.txt`))
+		require.NoFileExists(t, filepath.Join(tmpDir, "demo", "a", "notes.txt"))
+		requireContent(t, "demo\n1.2.3\n", filepath.Join(tmpDir, "docs", "NOTES.txt"))
+
+		require.NoError(t, runAction(t, tmpDir, "", `remove: ["demo/*", "**/*.txt"]`))
+		require.NoDirExists(t, filepath.Join(tmpDir, "demo", "a"))
+		require.NoDirExists(t, filepath.Join(tmpDir, "demo", "b"))
+		require.NoFileExists(t, filepath.Join(tmpDir, "docs", "NOTES.txt"))
+	})
+
+	t.Run("copy from layout", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		layoutDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(layoutDir, "assets", "img"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(layoutDir, "assets", "img", "logo.svg"), []byte("{{.name}}"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(layoutDir, "run.sh"), []byte("#!/bin/sh"), 0755))
+
+		require.NoError(t, runAction(t, tmpDir, layoutDir, `
+copy:
+  from: assets
+  to: static`))
+		requireContent(t, "{{.name}}", filepath.Join(tmpDir, "static", "img", "logo.svg"))
+
+		require.NoError(t, runAction(t, tmpDir, layoutDir, `
+copy:
+  from: ../../run.sh
+  to: bin/run.sh`))
+		info, err := os.Stat(filepath.Join(tmpDir, "bin", "run.sh"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	})
+
+	t.Run("chmod", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "bin"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "bin", "app"), nil, 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "bin", "app.conf"), nil, 0644))
+
+		require.NoError(t, runAction(t, tmpDir, "", `
+chmod:
+  "bin/*": 0755
+  "*.conf": 0600`))
+		info, err := os.Stat(filepath.Join(tmpDir, "bin", "app"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+		info, err = os.Stat(filepath.Join(tmpDir, "bin", "app.conf"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	})
+
+	t.Run("replace in file", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		file := filepath.Join(tmpDir, "go.mod")
+		require.NoError(t, os.WriteFile(file, []byte("module example.com/app\n\ngo 1.18\n"), 0600))
+
+		require.NoError(t, runAction(t, tmpDir, "", `
+replace_in_file:
+  file: go.mod
+  pattern: 'module \S+'
+  replace: "module github.com/{{.name}}/app"`))
+		requireContent(t, "module github.com/demo/app\n\ngo 1.18\n", file)
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		require.Error(t, runAction(t, tmpDir, "", `
+replace_in_file:
+  file: go.mod
+  pattern: '('`))
+	})
+
+	t.Run("json patch keeps order", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		file := filepath.Join(tmpDir, "package.json")
+		require.NoError(t, os.WriteFile(file, []byte(`{
+    "name": "app",
+    "version": "0.0.0",
+    "private": true,
+    "scripts": {"test": "jest", "lint": "eslint"},
+    "files": ["dist"]
+}`), 0644))
+
+		require.NoError(t, runAction(t, tmpDir, "", `
+json_patch:
+  file: package.json
+  set:
+    name: "{{.name}}"
+    version: "{{.version}}"
+    scripts.build: tsc
+    files.1: lib
+    engines.node: 18
+  delete:
+    - private
+    - scripts.lint`))
+		requireContent(t, `{
+    "name": "demo",
+    "version": "1.2.3",
+    "scripts": {
+        "test": "jest",
+        "build": "tsc"
+    },
+    "files": [
+        "dist",
+        "lib"
+    ],
+    "engines": {
+        "node": 18
+    }
+}
+`, file)
+	})
+
+	t.Run("yaml patch keeps comments", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		file := filepath.Join(tmpDir, "config.yaml")
+		require.NoError(t, os.WriteFile(file, []byte("# service config\nname: app # service name\nport: 8080\ndebug: true\n"), 0644))
+
+		require.NoError(t, runAction(t, tmpDir, "", `
+yaml_patch:
+  file: config.yaml
+  set:
+    name: "{{.name}}"
+    tags: ["{{.version}}"]
+  delete: [debug]`))
+		requireContent(t, "# service config\nname: demo # service name\nport: 8080\ntags:\n  - 1.2.3\n", file)
+	})
+
+	t.Run("git init commits files", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "README.md"), []byte("# demo"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, ".gitignore"), []byte("*.log\n"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "debug.log"), []byte("debug"), 0644))
+
+		require.NoError(t, runAction(t, tmpDir, "", `
+git_init:
+  branch: trunk
+  message: "Init {{.name}}"`))
+
+		repo, err := git.PlainOpen(tmpDir)
+		require.NoError(t, err)
+		head, err := repo.Head()
+		require.NoError(t, err)
+		require.Equal(t, "refs/heads/trunk", head.Name().String())
+		commit, err := repo.CommitObject(head.Hash())
+		require.NoError(t, err)
+		require.Equal(t, "Init demo", commit.Message)
+		_, err = commit.File("README.md")
+		require.NoError(t, err)
+		_, err = commit.File("debug.log")
+		require.Error(t, err, "ignored files should not be committed")
+	})
+
+	t.Run("only one action allowed", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		err := runAction(t, tmpDir, "", `
+mkdir: [a]
+remove: [b]`)
+		require.Error(t, err)
+	})
+
+	t.Run("restricted mode limits writes", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		sandboxed := withSandbox(ctx, (&Sandbox{}).writableAt(filepath.Join(tmpDir, "allowed")))
+		hook := Hook{Runnable: Runnable{Action: Action{Mkdir: []string{"allowed/dir"}}}}
+		require.NoError(t, hook.execute(sandboxed, newRenderContext(state), tmpDir, ""))
+		hook = Hook{Runnable: Runnable{Action: Action{Mkdir: []string{"other"}}}}
+		require.Error(t, hook.execute(sandboxed, newRenderContext(state), tmpDir, ""))
+	})
+}
+
+func TestGitInit(t *testing.T) {
+	t.Run("manifest option", func(t *testing.T) {
+		source := createDir(map[string]string{
+			"layout.yaml": `
+prompts:
+  - var: owner
+    default: demo
+git_init:
+  branch: develop
+  remote: "git@github.com:{{.owner}}/{{.dirname}}.git"
+  author: "{{.owner}}"
+  email: "{{.owner}}@example.com"
+`,
+			"content/README.md":  "readme",
+			"content/.gitignore": "*.log\n",
+			"content/debug.log":  "debug",
+		})
+		defer os.RemoveAll(source)
+
+		dest := filepath.Join(t.TempDir(), "project")
+		err := Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true, Display: &defaultsUI{}})
+		require.NoError(t, err)
+
+		repo, err := git.PlainOpen(dest)
+		require.NoError(t, err)
+		remote, err := repo.Remote("origin")
+		require.NoError(t, err)
+		require.Equal(t, []string{"git@github.com:demo/project.git"}, remote.Config().URLs)
+
+		head, err := repo.Head()
+		require.NoError(t, err)
+		require.Equal(t, "refs/heads/develop", head.Name().String())
+		commit, err := repo.CommitObject(head.Hash())
+		require.NoError(t, err)
+		require.Equal(t, "demo", commit.Author.Name)
+		require.Equal(t, "demo@example.com", commit.Author.Email)
+		_, err = commit.File("README.md")
+		require.NoError(t, err)
+		_, err = commit.File("debug.log")
+		require.Error(t, err, "ignored files should not be committed")
+	})
+
+	t.Run("config option", func(t *testing.T) {
+		source := createDir(map[string]string{
+			"layout.yaml":       `title: demo`,
+			"content/README.md": "readme",
+		})
+		defer os.RemoveAll(source)
+
+		dest := filepath.Join(t.TempDir(), "project")
+		err := Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true, GitInit: true})
+		require.NoError(t, err)
+
+		repo, err := git.PlainOpen(dest)
+		require.NoError(t, err)
+		head, err := repo.Head()
+		require.NoError(t, err)
+		require.Equal(t, "refs/heads/main", head.Name().String())
+	})
+
+	t.Run("answers are committed", func(t *testing.T) {
+		source := createDir(map[string]string{
+			"layout.yaml": `
+git_init: true
+generators:
+  - name: doc
+`,
+			"content/README.md":             "readme",
+			"generators/doc/content/doc.md": "doc",
+		})
+		defer os.RemoveAll(source)
+
+		dest := filepath.Join(t.TempDir(), "project")
+		err := Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true})
+		require.NoError(t, err)
+		require.FileExists(t, filepath.Join(dest, AnswersFile))
+
+		repo, err := git.PlainOpen(dest)
+		require.NoError(t, err)
+		worktree, err := repo.Worktree()
+		require.NoError(t, err)
+		status, err := worktree.Status()
+		require.NoError(t, err)
+		require.True(t, status.IsClean(), "project should be clean after initial commit: %s", status)
+	})
+
+	t.Run("existing repository skipped", func(t *testing.T) {
+		source := createDir(map[string]string{
+			"layout.yaml":       `title: demo`,
+			"content/README.md": "readme",
+		})
+		defer os.RemoveAll(source)
+
+		dest := t.TempDir()
+		_, err := git.PlainInit(dest, false)
+		require.NoError(t, err)
+
+		err = Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true, GitInit: true})
+		require.NoError(t, err)
+		requireContent(t, "readme", filepath.Join(dest, "README.md"))
+
+		repo, err := git.PlainOpen(dest)
+		require.NoError(t, err)
+		_, err = repo.Head()
+		require.Error(t, err, "no commits should be made in existing repository")
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		source := createDir(map[string]string{
+			"layout.yaml":       `git_init: false`,
+			"content/README.md": "readme",
+		})
+		defer os.RemoveAll(source)
+
+		dest := filepath.Join(t.TempDir(), "project")
+		err := Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true})
+		require.NoError(t, err)
+		require.NoDirExists(t, filepath.Join(dest, ".git"))
+	})
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var identifier = regexp.MustCompile(`[a-zA-Z_][a-zA-Z0-9_]*`)
+
+// AssertionError contains messages of all failed assertions.
+type AssertionError struct {
+	Messages []string
+	vars     map[string]bool // identifiers used in failed expressions
+}
+
+func (ae *AssertionError) Error() string {
+	return "assertions failed:\n - " + strings.Join(ae.Messages, "\n - ")
+}
+
+// check all assertions. Returns AssertionError with all failed assertions or other error if assertion can not be evaluated.
+func checkAssertions(ctx context.Context, renderer *renderContext, asserts []Assert) error {
+	var failed = &AssertionError{vars: make(map[string]bool)}
+	for i, a := range asserts {
+		ok, err := a.Expr.Eval(ctx, renderer.State())
+		if err != nil {
+			return fmt.Errorf("evaluate assertion #%d: %w", i, err)
+		}
+		if ok {
+			continue
+		}
+		message := strings.TrimSpace(string(a.Expr))
+		if a.Message != "" {
+			message, err = renderer.Render(a.Message)
+			if err != nil {
+				return fmt.Errorf("render message of assertion #%d: %w", i, err)
+			}
+		}
+		failed.Messages = append(failed.Messages, message)
+		for _, name := range identifier.FindAllString(string(a.Expr), -1) {
+			failed.vars[name] = true
+		}
+	}
+	if len(failed.Messages) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// answers which should be kept during re-asking: all state except variables involved in failed assertions,
+// including variables used by involved computed values (transitively).
+func (ae *AssertionError) keepAnswers(state map[string]interface{}, computed []Computed) map[string]interface{} {
+	for changed := true; changed; {
+		changed = false
+		for _, c := range computed {
+			if !ae.vars[c.Var] {
+				continue
+			}
+			source := strings.Join([]string{c.Expr, c.Script, string(c.When), fmt.Sprint(c.Value)}, " ")
+			for _, name := range identifier.FindAllString(source, -1) {
+				if !ae.vars[name] {
+					ae.vars[name] = true
+					changed = true
+				}
+			}
+		}
+	}
+	var answers = make(map[string]interface{}, len(state))
+	for k, v := range state {
+		if !ae.vars[k] {
+			answers[k] = v
+		}
+	}
+	return answers
+}
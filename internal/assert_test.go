@@ -0,0 +1,108 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/reddec/layout/internal/ui/simple"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const assertLayout = `
+prompts:
+  - var: go_version
+  - var: grpc
+    type: bool
+computed:
+  - var: modern
+    expr: 'layout.semverCompare(">= 1.20", go_version)'
+assert:
+  - expr: '!grpc || modern'
+    message: "gRPC requires Go >= 1.20, got {{.go_version}}"
+  - expr: 'go_version != "1.0"'
+`
+
+func TestAssert(t *testing.T) {
+	source := createDir(map[string]string{
+		"layout.yaml":      assertLayout,
+		"content/info.txt": "{{.go_version}}",
+	})
+	defer os.RemoveAll(source)
+
+	t.Run("all failed assertions listed", func(t *testing.T) {
+		dest, err := os.MkdirTemp("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		err = Deploy(context.Background(), Config{
+			Source:  source,
+			Target:  filepath.Join(dest, "project"),
+			Answers: map[string]interface{}{"go_version": "1.0", "grpc": "yes"},
+			AskOnce: true,
+		})
+		var assertErr *AssertionError
+		require.True(t, errors.As(err, &assertErr), err)
+		assert.Equal(t, []string{"gRPC requires Go >= 1.20, got 1.0", `go_version != "1.0"`}, assertErr.Messages)
+		assert.NoDirExists(t, filepath.Join(dest, "project"), "nothing should be copied")
+	})
+
+	t.Run("re-answer involved prompts", func(t *testing.T) {
+		dest, err := os.MkdirTemp("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		input := strings.NewReader(strings.Join([]string{
+			"1.19", // go_version
+			"yes",  // grpc
+			"1",    // re-answer
+			"1.21", // go_version
+			"yes",  // grpc
+		}, "\n") + "\n")
+		err = Deploy(context.Background(), Config{
+			Source:  source,
+			Target:  dest,
+			Display: simple.New(bufio.NewReader(input), io.Discard),
+		})
+		require.NoError(t, err)
+		requireContent(t, "1.21", filepath.Join(dest, "info.txt"))
+	})
+
+	t.Run("declined re-answer", func(t *testing.T) {
+		dest, err := os.MkdirTemp("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		input := strings.NewReader("1.19\nyes\n2\n")
+		err = Deploy(context.Background(), Config{
+			Source:  source,
+			Target:  dest,
+			Display: simple.New(bufio.NewReader(input), io.Discard),
+		})
+		var assertErr *AssertionError
+		require.True(t, errors.As(err, &assertErr), err)
+		assert.Len(t, assertErr.Messages, 1)
+	})
+}
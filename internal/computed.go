@@ -21,7 +21,7 @@ import (
 	"fmt"
 )
 
-// compute variable: render value (if string) and convert it to desired type.
+// compute variable: evaluate expression or script, or render value (if string) and convert it to desired type.
 // If value is not string, it will be returned as-is
 func (c Computed) compute(ctx context.Context, renderer *renderContext) error {
 	ok, err := c.When.Ok(ctx, renderer.State())
@@ -33,43 +33,77 @@ func (c Computed) compute(ctx context.Context, renderer *renderContext) error {
 		return nil
 	}
 
-	stringValue, ok := c.Value.(string)
-	if !ok {
-		renderer.Save(c.Var, c.Value)
-		return nil
-	}
-
-	value, err := renderer.Render(stringValue)
+	value, err := computeValue(ctx, renderer, c.Value, c.Expr, c.Script, c.Type)
 	if err != nil {
-		return fmt.Errorf("render value: %w", err)
+		return err
 	}
+	renderer.Save(c.Var, value)
+	return nil
+}
 
-	parsed, err := c.Type.Parse(value)
+// condition-less default variable: evaluate expression or script, or render value (if string) and convert it to
+// desired type. If value is not string, it will be returned as-is
+func (d Default) compute(ctx context.Context, renderer *renderContext) error {
+	value, err := computeValue(ctx, renderer, d.Value, d.Expr, d.Script, d.Type)
 	if err != nil {
-		return fmt.Errorf("parse value: %w", err)
+		return err
 	}
-	renderer.Save(c.Var, parsed)
+	renderer.Save(d.Var, value)
 	return nil
 }
 
-// condition-less default variable: render value (if string) and convert it to desired type.
-// If value is not string, it will be returned as-is
-func (d Default) compute(renderer *renderContext) error {
-	stringValue, ok := d.Value.(string)
+func computeValue(ctx context.Context, renderer *renderContext, value interface{}, expr, script string, varType VarType) (interface{}, error) {
+	switch {
+	case expr != "":
+		res, err := evalExpr(ctx, expr, renderer.State())
+		if err != nil {
+			return nil, fmt.Errorf("evaluate expression: %w", err)
+		}
+		return convertScriptValue(res, varType)
+	case script != "":
+		res, err := evalScript(ctx, script, renderer.State())
+		if err != nil {
+			return nil, fmt.Errorf("evaluate script: %w", err)
+		}
+		return convertScriptValue(res, varType)
+	}
+
+	stringValue, ok := value.(string)
 	if !ok {
-		renderer.Save(d.Var, d.Value)
-		return nil
+		return value, nil
 	}
 
-	value, err := renderer.Render(stringValue)
+	rendered, err := renderer.Render(stringValue)
 	if err != nil {
-		return fmt.Errorf("render value: %w", err)
+		return nil, fmt.Errorf("render value: %w", err)
 	}
 
-	parsed, err := d.Type.Parse(value)
+	parsed, err := varType.Parse(rendered)
 	if err != nil {
-		return fmt.Errorf("parse value: %w", err)
+		return nil, fmt.Errorf("parse value: %w", err)
+	}
+	return parsed, nil
+}
+
+// script results stored with native types, except strings, which are parsed by type (if set), and arrays
+// for list type, which are converted to list of strings as for prompts.
+func convertScriptValue(value interface{}, varType VarType) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if varType == "" {
+			return v, nil
+		}
+		return varType.Parse(v)
+	case []interface{}:
+		if varType != VarList {
+			return v, nil
+		}
+		var list = make([]string, 0, len(v))
+		for _, item := range v {
+			list = append(list, fmt.Sprint(item))
+		}
+		return list, nil
+	default:
+		return v, nil
 	}
-	renderer.Save(d.Var, parsed)
-	return nil
 }
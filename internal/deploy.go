@@ -36,16 +36,24 @@ const (
 
 // Config of layout deployment.
 type Config struct {
-	Source   string                 // git URL, shorthand, or path to directory
-	Target   string                 // destination directory
-	Aliases  map[string]string      // aliases (abbreviations) for cloning, values may contain {0} placeholder
-	Default  string                 // default alias (for cloning without abbreviations, such as owner/repo), value may contain {0} placeholder, default is Github
-	Display  ui.UI                  // how to interact with user, default is Simple TUI
-	Debug    bool                   // enable debug messages and tracing
-	Version  string                 // current version, used to filter manifests by constraints
-	AskOnce  bool                   // do not try to ask for user input after wrong value and interrupt deployment
-	Git      gitclient.Client       // Git client, default is gitclient.Auto
-	Defaults map[string]interface{} // Global default values
+	Source         string                 // git URL, shorthand, or path to directory
+	Target         string                 // destination directory
+	Aliases        map[string]string      // aliases (abbreviations) for cloning, values may contain {0} placeholder
+	Default        string                 // default alias (for cloning without abbreviations, such as owner/repo), value may contain {0} placeholder, default is Github
+	Display        ui.UI                  // how to interact with user, default is Simple TUI
+	Debug          bool                   // enable debug messages and tracing
+	Version        string                 // current version, used to filter manifests by constraints
+	AskOnce        bool                   // do not try to ask for user input after wrong value and interrupt deployment
+	Git            gitclient.Client       // Git client, default is gitclient.Auto
+	Defaults       map[string]interface{} // Global default values
+	Answers        map[string]interface{} // Pre-defined answers for prompts, answered prompts will not be asked
+	HooksLog       string                 // file where hooks output will be appended, by default temporary file is used and kept only on failure
+	Trusted        []string               // remote layouts (sources, URLs, or URL prefixes ended by / or :) which hooks are executed without confirmation
+	NoInput        bool                   // do not ask for confirmation of hooks from untrusted layouts and fail instead
+	Sandbox        *Sandbox               // restrictions for hooks, nil means no restrictions
+	HooksWorkers   int                    // maximum number of concurrently executed hooks of parallel group, default is 4
+	GitInit        bool                   // initialize git repository in destination even if manifest does not define it
+	DisableCleanup bool                   // do not roll back failed generation, keep staged or backed up files for debugging
 }
 
 func (cfg Config) withDefaults(ctx context.Context) Config {
@@ -70,42 +78,12 @@ func Deploy(ctx context.Context, config Config) error {
 		return fmt.Errorf("calculate abs path: %w", err)
 	}
 
-	var projectDir string
-
-	// strategy
-	// - try as directory
-	// - try as default
-	// - try as aliased
-	// - try as git URL
-
-	info, err := os.Stat(config.Source)
-	alias, repo := splitAbbreviation(config.Source)
-	repoTemplate, aliasExist := config.Aliases[alias]
-	url := config.Source
-
-	switch {
-	case err == nil && info.IsDir(): // first try as directory
-		projectDir = config.Source
-	case !strings.Contains(config.Source, ":"): // ok, let's try as remote. If we don't have delimiter it's shorthand for default template
-		// this is default case since url should contain either abbreviation or protocol delimited by :
-		repoTemplate = config.Default
-		fallthrough
-	case aliasExist: // we found abbreviation template
-		url = strings.ReplaceAll(repoTemplate, "{0}", repo)
-		// alias may point to the dir too
-		if info, err := os.Stat(url); err == nil && info.IsDir() {
-			projectDir = url
-			break
-		}
-		fallthrough
-	default: // finally all we need is to pull remote repository by URL
-		tmpDir, err := cloneFromGit(ctx, config.Git, url)
-		if err != nil {
-			return fmt.Errorf("copy project from git %s: %w", url, err)
-		}
-		defer os.RemoveAll(tmpDir)
-		projectDir = tmpDir
+	projectDir, cleanup, err := fetchLayout(ctx, config, config.Source)
+	if err != nil {
+		return err
 	}
+	defer cleanup()
+	rootDir := projectDir
 
 	manifestFiles, err := findManifests(projectDir)
 	if err != nil {
@@ -142,20 +120,86 @@ func Deploy(ctx context.Context, config Config) error {
 		return fmt.Errorf("manifest version constraint (%s) requires another version of application (current %s)", manifest.Version, config.Version)
 	}
 
-	err = manifest.renderTo(ctx, config.Display, targetDir, projectDir, config.Debug, config.AskOnce, config.Defaults)
+	layoutPath, err := filepath.Rel(rootDir, projectDir)
 	if err != nil {
-		return fmt.Errorf("render: %w", err)
+		return fmt.Errorf("calculate layout path: %w", err)
 	}
 
+	manifest, projectDir, cleanupComposed, err := manifest.compose(ctx, config, projectDir, 0)
+	if err != nil {
+		return fmt.Errorf("compose layout: %w", err)
+	}
+	defer cleanupComposed()
+
+	if err := confirmHooks(ctx, config, append([]string{config.Source}, manifest.remotes...), manifest.hooks()); err != nil {
+		return err
+	}
+
+	// answers needed only to apply generators later
+	var answers *Answers
+	if len(manifest.Generators) > 0 {
+		answers = newAnswers(config.Source, layoutPath, nil)
+	}
+
+	if _, err := manifest.renderTo(ctx, config, targetDir, projectDir, answers); err != nil {
+		return fmt.Errorf("render: %w", err)
+	}
 	return nil
 }
 
+// fetch layout by source: local directory, abbreviation, or git URL. Cleanup function should be called by caller
+// once layout is not needed.
+func fetchLayout(ctx context.Context, config Config, source string) (projectDir string, cleanup func(), err error) {
+	cleanup = func() {}
+	projectDir, url := resolveSource(config, source)
+	if projectDir != "" {
+		return projectDir, cleanup, nil
+	}
+	// finally all we need is to pull remote repository by URL
+	tmpDir, err := cloneFromGit(ctx, config.Git, url)
+	if err != nil {
+		return "", cleanup, fmt.Errorf("copy project from git %s: %w", url, err)
+	}
+	cleanup = func() { _ = os.RemoveAll(tmpDir) }
+	return tmpDir, cleanup, nil
+}
+
+// resolve source to local directory or, if source is remote, to git URL.
+func resolveSource(config Config, source string) (localDir string, url string) {
+	// strategy
+	// - try as directory
+	// - try as default
+	// - try as aliased
+	// - try as git URL
+
+	info, err := os.Stat(source)
+	alias, repo := splitAbbreviation(source)
+	repoTemplate, aliasExist := config.Aliases[alias]
+	url = source
+
+	switch {
+	case err == nil && info.IsDir(): // first try as directory
+		return source, ""
+	case !strings.Contains(source, ":"): // ok, let's try as remote. If we don't have delimiter it's shorthand for default template
+		// this is default case since url should contain either abbreviation or protocol delimited by :
+		repoTemplate = config.Default
+		fallthrough
+	case aliasExist: // we found abbreviation template
+		url = strings.ReplaceAll(repoTemplate, "{0}", repo)
+		// alias may point to the dir too
+		if info, err := os.Stat(url); err == nil && info.IsDir() {
+			return url, ""
+		}
+	}
+	return "", url
+}
+
 func selectManifest(ctx context.Context, display ui.UI, manifests []string) (string, error) {
 	var options []string
 	for _, m := range manifests {
 		manifest, err := loadManifest(m)
 		if err != nil {
-			return "", fmt.Errorf("read manifest %s: %w", manifest, err)
+			return "", fmt.Errorf("read manifest %s: %w", m, err)
 		}
 		options = append(options, manifest.Title)
 	}
@@ -214,11 +258,20 @@ func cloneFromGit(ctx context.Context, client gitclient.Client, url string) (pro
 	return tmpDir, nil
 }
 
-func CopyTree(src string, dest string) (*FSTree, error) {
+// PathMapper returns new relative (slash-separated) path of file or directory in destination by relative
+// (slash-separated) path in source. Empty string means that file or directory (with all children) should be skipped.
+type PathMapper func(relPath string, info fs.FileInfo) (string, error)
+
+// CopyTree copies content of source directory to the destination and returns tree of copied files.
+// Optional mappers applied in order to each source path: any mapper may skip the path, and the last mapper which
+// changed the path defines destination. Children of moved directory are moved together with parent.
+func CopyTree(src string, dest string, mappers ...PathMapper) (*FSTree, error) {
 	var root = &FSTree{
 		Name: dest,
 		Dir:  true,
 	}
+	var movedDirs = make(map[string]string) // source rel path -> destination rel path
+	var dirs []dirMode
 	err := filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -227,37 +280,101 @@ func CopyTree(src string, dest string) (*FSTree, error) {
 			return nil
 		}
 		relPath, err := filepath.Rel(src, path)
-		destPath := filepath.Join(dest, relPath)
-		root.Add(relPath, info.IsDir())
-		if info.IsDir() {
-			err := os.Mkdir(destPath, info.Mode())
-			if os.IsExist(err) {
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		targetPath := relPath
+		if parent, ok := movedDirs[filepath.ToSlash(filepath.Dir(relPath))]; ok {
+			targetPath = parent + "/" + info.Name()
+		}
+		for _, mapper := range mappers {
+			mapped, err := mapper(relPath, info)
+			if err != nil {
+				return fmt.Errorf("map %s: %w", relPath, err)
+			}
+			if mapped == "" {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
 				return nil
 			}
-			return err
+			if mapped != relPath {
+				targetPath = mapped
+			}
 		}
-		srcFile, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("open source (%s): %w", path, err)
+		if info.IsDir() && targetPath != relPath {
+			movedDirs[relPath] = targetPath
 		}
-		defer srcFile.Close()
 
-		destFile, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY, info.Mode())
-		if err != nil {
-			return fmt.Errorf("open destination (%s): %w", path, err)
+		destPath := filepath.Join(dest, filepath.FromSlash(targetPath))
+		root.Add(filepath.FromSlash(targetPath), info.IsDir()).Source = relPath
+		if info.IsDir() {
+			dirs = append(dirs, dirMode{path: destPath, mode: info.Mode()})
+			return os.MkdirAll(destPath, 0755)
 		}
-		defer destFile.Close()
-
-		_, err = io.Copy(destFile, srcFile)
-		if err != nil {
-			return fmt.Errorf("copy content (%s): %w", relPath, err)
+		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			return fmt.Errorf("create parent directory (%s): %w", targetPath, err)
 		}
-
-		return destFile.Close()
+		// remove previous file (if exists) since it could be read-only or symlink
+		if err := os.Remove(destPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove old destination (%s): %w", targetPath, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return copySymlink(path, destPath)
+		}
+		if err := copyFile(path, destPath); err != nil {
+			return fmt.Errorf("copy (%s): %w", relPath, err)
+		}
+		return os.Chmod(destPath, info.Mode())
 	})
+	if err != nil {
+		return root, err
+	}
+	// set directories modes at the end, since they could be read-only
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return root, fmt.Errorf("set directory mode: %w", err)
+		}
+	}
 	return root, err
 }
 
+type dirMode struct {
+	path string
+	mode os.FileMode
+}
+
+// copy symlink as-is without following it.
+func copySymlink(src, dest string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return fmt.Errorf("read link %s: %w", src, err)
+	}
+	return os.Symlink(target, dest)
+}
+
+// copy regular file content, destination file should not exist.
+func copyFile(src, dest string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open source: %w", err)
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("open destination: %w", err)
+	}
+	defer destFile.Close()
+
+	if _, err := io.Copy(destFile, srcFile); err != nil {
+		return fmt.Errorf("copy content: %w", err)
+	}
+	return destFile.Close()
+}
+
 func splitAbbreviation(text string) (abbrev, repo string) {
 	parts := strings.SplitN(text, ":", 2)
 	if len(parts) == 1 {
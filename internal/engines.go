@@ -0,0 +1,258 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/flosch/pongo2/v6"
+)
+
+const (
+	EngineGo       = "go"       // golang text/template with sprig functions and partials (default)
+	EngineEnvsubst = "envsubst" // shell-like substitution of $var and ${var}
+	EngineJinja    = "jinja"    // Jinja-like templates (pongo2), partials available for include/extends/import
+	EngineNone     = "none"     // content copied as-is
+)
+
+// Engine renders template text using state as context. Implementations should be safe for concurrent usage.
+type Engine interface {
+	Render(value string, state map[string]interface{}) (string, error)
+}
+
+// EngineFunc is a function adapter for Engine.
+type EngineFunc func(value string, state map[string]interface{}) (string, error)
+
+func (ef EngineFunc) Render(value string, state map[string]interface{}) (string, error) {
+	return ef(value, state)
+}
+
+// goEngine is text/template engine which shares cache, functions and partials with render context.
+type goEngine struct {
+	renderer *renderContext
+	open     string
+	close    string
+}
+
+func (ge *goEngine) Render(value string, state map[string]interface{}) (string, error) {
+	return ge.renderer.execute(ge.open, ge.close, value, state)
+}
+
+var envsubstVar = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)(:?-(.*))?$`)
+
+// envsubst replaces $name, ${name} and ${name:-default} (or ${name-default}) by values from state.
+// Undefined variables replaced by empty string (or by default). Everything else, including special shell
+// variables ($$, $1), non-identifiers in braces (${{ expr }}), and unterminated ${, kept as-is.
+func envsubst(value string, state map[string]interface{}) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(value); {
+		if value[i] != '$' || i+1 == len(value) {
+			out.WriteByte(value[i])
+			i++
+			continue
+		}
+		switch next := value[i+1]; {
+		case next == '{':
+			end := strings.IndexByte(value[i+2:], '}')
+			if end == -1 {
+				out.WriteString(value[i:])
+				return out.String(), nil
+			}
+			expr := value[i+2 : i+2+end]
+			if m := envsubstVar.FindStringSubmatch(expr); m != nil {
+				out.WriteString(envsubstValue(m, state))
+			} else {
+				out.WriteString("${" + expr + "}")
+			}
+			i += end + 3
+		case next == '_' || isASCIILetter(next):
+			end := i + 2
+			for end < len(value) && (value[end] == '_' || isASCIILetter(value[end]) || ('0' <= value[end] && value[end] <= '9')) {
+				end++
+			}
+			out.WriteString(envsubstValue([]string{"", value[i+1 : end], "", ""}, state))
+			i = end
+		default:
+			out.WriteByte('$')
+			i++
+		}
+	}
+	return out.String(), nil
+}
+
+// value of variable by match of envsubstVar: name, default part, and default value.
+func envsubstValue(m []string, state map[string]interface{}) string {
+	v, ok := state[m[1]]
+	if m[2] != "" {
+		colon := strings.HasPrefix(m[2], ":")
+		if !ok || v == nil || (colon && fmt.Sprint(v) == "") {
+			return m[3]
+		}
+	}
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func isASCIILetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+var disableAutoescape sync.Once
+
+// jinjaEngine renders pongo2 templates. Templates from partials directory available by relative path.
+type jinjaEngine struct {
+	lock sync.Mutex // template set is not safe for concurrent parsing
+	set  *pongo2.TemplateSet
+}
+
+// Templates from later directories override templates with the same path from earlier directories.
+func newJinjaEngine(partialsDirs []string) *jinjaEngine {
+	disableAutoescape.Do(func() {
+		// generated files are not HTML
+		pongo2.SetAutoescape(false)
+	})
+	var loaders []pongo2.TemplateLoader
+	for i := len(partialsDirs) - 1; i >= 0; i-- {
+		loaders = append(loaders, pongo2.NewFSLoader(os.DirFS(partialsDirs[i])))
+	}
+	if len(loaders) == 0 {
+		loaders = append(loaders, noTemplatesLoader{})
+	}
+	return &jinjaEngine{
+		set: pongo2.NewSet("layout", loaders...),
+	}
+}
+
+// loader for layouts without partials: includes are not available.
+type noTemplatesLoader struct{}
+
+func (noTemplatesLoader) Abs(_, name string) string {
+	return name
+}
+
+func (noTemplatesLoader) Get(path string) (io.Reader, error) {
+	return nil, fmt.Errorf("template %s not found: layout has no partials", path)
+}
+
+func (je *jinjaEngine) Render(value string, state map[string]interface{}) (string, error) {
+	je.lock.Lock()
+	tpl, err := je.set.FromString(value)
+	je.lock.Unlock()
+	if err != nil {
+		return "", err
+	}
+	return tpl.Execute(state)
+}
+
+// files which are used only by jinja engine.
+func isJinjaFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".j2", ".jinja", ".jinja2":
+		return true
+	default:
+		return false
+	}
+}
+
+func noneEngine(value string, _ map[string]interface{}) (string, error) {
+	return value, nil
+}
+
+// Engine by name. Go engine uses delimiters from arguments or from context. Other engines registered by RegisterEngine
+// or built-in engines are shared between calls.
+func (r *renderContext) Engine(name string, delimiters Delimiters) (Engine, error) {
+	if name == "" || name == EngineGo {
+		engine := &goEngine{renderer: r, open: r.open, close: r.close}
+		if delimiters.Open != "" {
+			engine.open = delimiters.Open
+		}
+		if delimiters.Close != "" {
+			engine.close = delimiters.Close
+		}
+		return engine, nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if engine, ok := r.engines[name]; ok {
+		return engine, nil
+	}
+	var engine Engine
+	switch name {
+	case EngineEnvsubst:
+		engine = EngineFunc(envsubst)
+	case EngineJinja:
+		engine = newJinjaEngine(r.partialsDirs)
+	case EngineNone:
+		engine = EngineFunc(noneEngine)
+	default:
+		return nil, fmt.Errorf("unknown template engine %q", name)
+	}
+	if r.engines == nil {
+		r.engines = make(map[string]Engine)
+	}
+	r.engines[name] = engine
+	return engine, nil
+}
+
+// RegisterEngine adds (or replaces) custom engine which can be referenced from manifest by name.
+// Go engine can not be replaced.
+func (r *renderContext) RegisterEngine(name string, engine Engine) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.engines == nil {
+		r.engines = make(map[string]Engine)
+	}
+	r.engines[name] = engine
+}
+
+// engineSelector returns function which picks engine for content file by source path: the last matched rule wins,
+// go engine with default delimiters used if nothing matched. Nil engine means that file should not be rendered.
+func (r *renderContext) engineSelector(rules EngineRules) (func(relPath string) Engine, error) {
+	defaultEngine, err := r.Engine(EngineGo, Delimiters{})
+	if err != nil {
+		return nil, err
+	}
+	var engines = make([]Engine, 0, len(rules))
+	var matchers = make([]*globMatcher, 0, len(rules))
+	for i, rule := range rules {
+		engine, err := r.Engine(rule.Engine, rule.Delimiters)
+		if err != nil {
+			return nil, fmt.Errorf("engine rule #%d (%s): %w", i, rule.Glob, err)
+		}
+		if rule.Engine == EngineNone {
+			engine = nil
+		}
+		engines = append(engines, engine)
+		matchers = append(matchers, newGlobMatcher([]string{rule.Glob}))
+	}
+	return func(relPath string) Engine {
+		for i := len(rules) - 1; i >= 0; i-- {
+			if matchers[i].Match(relPath, false) {
+				return engines[i]
+			}
+		}
+		return defaultEngine
+	}, nil
+}
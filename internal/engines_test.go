@@ -0,0 +1,148 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvsubst(t *testing.T) {
+	state := map[string]interface{}{"name": "alice", "empty": "", "count": 3}
+	cases := map[string]string{
+		"hello $name":                          "hello alice",
+		"hello ${name}!":                       "hello alice!",
+		"${count} items":                       "3 items",
+		"[${missing}]":                         "[]",
+		"${missing:-bob} ${name:-bob}":         "bob alice",
+		"${empty:-x} ${empty-x}":               "x ",
+		"${{ github.ref }} $$ $1":              "${{ github.ref }} $$ $1",
+		"run: echo ${{ secrets.TOKEN }} $name": "run: echo ${{ secrets.TOKEN }} alice",
+		"price: 5$ or $":                       "price: 5$ or $",
+		"${} ${name":                           "${} ${name",
+		"unterminated ${ and $name":            "unterminated ${ and $name",
+		"$name_1${name}_$9":                    "alice_$9",
+	}
+	for value, expected := range cases {
+		v, err := envsubst(value, state)
+		require.NoError(t, err)
+		assert.Equal(t, expected, v, value)
+	}
+}
+
+func TestEngines(t *testing.T) {
+	partials := createDir(map[string]string{
+		"header.j2":   "# {{ name|upper }}",
+		"header.tmpl": "# {{.name}}",
+	})
+	defer os.RemoveAll(partials)
+
+	r := newRenderContext(map[string]interface{}{"name": "alice"})
+	require.NoError(t, r.Partials(partials))
+
+	t.Run("jinja", func(t *testing.T) {
+		engine, err := r.Engine(EngineJinja, Delimiters{})
+		require.NoError(t, err)
+		v, err := engine.Render(`{% include "header.j2" %}
+{% for i in items %}{{ i }}<{% endfor %}`, map[string]interface{}{"name": "alice", "items": []string{"a", "b"}})
+		require.NoError(t, err)
+		assert.Equal(t, "# ALICE\na<b<", v)
+	})
+
+	t.Run("jinja without partials can not include files", func(t *testing.T) {
+		engine, err := newRenderContext(nil).Engine(EngineJinja, Delimiters{})
+		require.NoError(t, err)
+		_, err = engine.Render(`{% include "engines.go" %}`, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("go with custom delimiters and partials", func(t *testing.T) {
+		engine, err := r.Engine(EngineGo, Delimiters{Open: "[[", Close: "]]"})
+		require.NoError(t, err)
+		v, err := engine.Render(`[[template "header" .]] {{ .Values.name }}`, r.State())
+		require.NoError(t, err)
+		assert.Equal(t, "# alice {{ .Values.name }}", v)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := r.Engine("mustache", Delimiters{})
+		require.Error(t, err)
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		r.RegisterEngine("upper", EngineFunc(func(value string, _ map[string]interface{}) (string, error) {
+			return "UPPER " + value, nil
+		}))
+		engine, err := r.Engine("upper", Delimiters{})
+		require.NoError(t, err)
+		v, err := engine.Render("x", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "UPPER x", v)
+	})
+}
+
+func TestEngineRules(t *testing.T) {
+	source := createDir(map[string]string{
+		"layout.yaml": `
+prompts:
+  - var: name
+engines:
+  - glob: "charts/**"
+    engine: none
+  - glob: "charts/values.yaml"
+    engine: envsubst
+  - glob: ".github/**"
+    engine: go
+    delimiters:
+      open: "<%"
+      close: "%>"
+  - glob: "*.j2"
+    engine: jinja
+`,
+		"content/{{.name}}.txt":              "hello {{.name}}",
+		"content/charts/templates/app.yaml":  "name: {{ .Release.Name }}",
+		"content/charts/values.yaml":         "owner: ${name}",
+		"content/.github/workflows/ci.yaml":  "ref: ${{ github.ref }} by <% .name %>",
+		"content/config.j2":                  "{% if name %}name={{ name }}{% endif %}",
+		"content/charts/{{.name}}/README.md": "{{.name}}",
+	})
+	defer os.RemoveAll(source)
+
+	dest, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	err = Deploy(context.Background(), Config{
+		Source:  source,
+		Target:  dest,
+		Answers: map[string]interface{}{"name": "alice"},
+		AskOnce: true,
+	})
+	require.NoError(t, err)
+
+	requireContent(t, "hello alice", filepath.Join(dest, "alice.txt"))
+	requireContent(t, "name: {{ .Release.Name }}", filepath.Join(dest, "charts", "templates", "app.yaml"))
+	requireContent(t, "owner: alice", filepath.Join(dest, "charts", "values.yaml"))
+	requireContent(t, "ref: ${{ github.ref }} by alice", filepath.Join(dest, ".github", "workflows", "ci.yaml"))
+	requireContent(t, "name=alice", filepath.Join(dest, "config.j2"))
+	requireContent(t, "{{.name}}", filepath.Join(dest, "charts", "alice", "README.md")) // names are still rendered by go engine
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+const maxExtendsDepth = 16 // protection against cyclic extends
+
+// UnmarshalYAML allows defining extend as plain string (source only) or as object.
+func (e *Extend) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		e.Source = value.Value
+		return nil
+	}
+	type plain Extend
+	return value.Decode((*plain)(e))
+}
+
+// compose layout with all base layouts from extends section (recursively). Returns merged manifest and directory
+// with merged layout: content of base layouts copied first (in order of definition), then content of current layout.
+// It means that files (content, hooks, includes, partials) of current layout override files of base layouts with the
+// same path, except ignore file, which is concatenated.
+//
+// All layouts are rendered by the same delimiters, so delimiters of base layouts (default if not defined) should be
+// equal, and current layout can only inherit them or define the same.
+//
+// If manifest has no extends, then the manifest and layout directory returned as-is.
+// Cleanup function should be called by caller once layout is not needed.
+func (m *Manifest) compose(ctx context.Context, config Config, layoutDir string, depth int) (*Manifest, string, func(), error) {
+	if len(m.Extends) == 0 {
+		return m, layoutDir, func() {}, nil
+	}
+	if depth >= maxExtendsDepth {
+		return nil, "", nil, fmt.Errorf("too deep extends (more than %d levels), probably cyclic", maxExtendsDepth)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "layout-composed-*")
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	cleanup := func() { _ = os.RemoveAll(tmpDir) }
+
+	var merged = &Manifest{}
+	for i, ext := range m.Extends {
+		base, err := m.mergeBase(ctx, config, layoutDir, tmpDir, ext, depth)
+		if err != nil {
+			cleanup()
+			return nil, "", nil, fmt.Errorf("extend #%d (%s): %w", i, ext.Source, err)
+		}
+		if i > 0 && base.Delimiters.orDefault() != merged.Delimiters.orDefault() {
+			cleanup()
+			return nil, "", nil, fmt.Errorf("extend #%d (%s): delimiters %s differ from delimiters %s of previous base layouts", i, ext.Source, base.Delimiters.orDefault(), merged.Delimiters.orDefault())
+		}
+		merged = merged.merge(base)
+	}
+
+	own := *m
+	own.Extends = nil
+	inherited := merged.Delimiters.orDefault()
+	if defined := merged.merge(&own).Delimiters.orDefault(); defined != inherited {
+		cleanup()
+		return nil, "", nil, fmt.Errorf("delimiters %s differ from delimiters %s of base layouts", defined, inherited)
+	}
+
+	if err := copyLayout(layoutDir, tmpDir); err != nil {
+		cleanup()
+		return nil, "", nil, fmt.Errorf("copy layout: %w", err)
+	}
+	return merged.merge(&own), tmpDir, cleanup, nil
+}
+
+// fetch, compose and copy base layout to the destination directory.
+func (m *Manifest) mergeBase(ctx context.Context, config Config, layoutDir string, destDir string, ext Extend, depth int) (*Manifest, error) {
+	baseDir, remote, cleanupFetched, err := fetchBase(ctx, config, layoutDir, ext.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanupFetched()
+
+	if ext.Dir != "" {
+		baseDir = filepath.Join(baseDir, path.Clean("/"+ext.Dir))
+	}
+
+	manifestFiles, err := findManifests(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("find manifests: %w", err)
+	}
+	if len(manifestFiles) != 1 {
+		return nil, fmt.Errorf("expected exactly one manifest, found %d, use dir to select layout", len(manifestFiles))
+	}
+
+	base, err := loadManifest(manifestFiles[0])
+	if err != nil {
+		return nil, fmt.Errorf("load manifest: %w", err)
+	}
+
+	if ok, err := base.isSupportedVersion(config.Version); err != nil {
+		return nil, fmt.Errorf("check manifest version: %w", err)
+	} else if !ok {
+		return nil, fmt.Errorf("manifest version constraint (%s) requires another version of application (current %s)", base.Version, config.Version)
+	}
+
+	base, baseDir, cleanupComposed, err := base.compose(ctx, config, filepath.Dir(manifestFiles[0]), depth+1)
+	if err != nil {
+		return nil, fmt.Errorf("compose: %w", err)
+	}
+	defer cleanupComposed()
+
+	if err := copyLayout(baseDir, destDir); err != nil {
+		return nil, fmt.Errorf("copy layout: %w", err)
+	}
+	if remote {
+		cp := *base
+		cp.remotes = append([]string{ext.Source}, base.remotes...)
+		base = &cp
+	}
+	return base, nil
+}
+
+// copy layout directory on top of composed layout. Git repository directory (of cloned layout) skipped, and ignore
+// file appended to the already copied one, so patterns of all layouts are kept.
+func copyLayout(layoutDir, destDir string) error {
+	_, err := CopyTree(layoutDir, destDir, func(relPath string, _ fs.FileInfo) (string, error) {
+		if relPath == ".git" || relPath == LayoutIgnoreFile {
+			return "", nil
+		}
+		return relPath, nil
+	})
+	if err != nil {
+		return err
+	}
+	patterns, err := os.ReadFile(filepath.Join(layoutDir, LayoutIgnoreFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read %s: %w", LayoutIgnoreFile, err)
+	}
+	f, err := os.OpenFile(filepath.Join(destDir, LayoutIgnoreFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", LayoutIgnoreFile, err)
+	}
+	defer f.Close()
+	if len(patterns) > 0 && patterns[len(patterns)-1] != '\n' {
+		patterns = append(patterns, '\n')
+	}
+	if _, err := f.Write(patterns); err != nil {
+		return fmt.Errorf("append %s: %w", LayoutIgnoreFile, err)
+	}
+	return f.Close()
+}
+
+// fetch base layout. Local path resolved relative to layout directory, otherwise the same logic as for deploy is used.
+// Remote flag is set if base layout is cloned (not a local directory).
+func fetchBase(ctx context.Context, config Config, layoutDir string, source string) (string, bool, func(), error) {
+	if !filepath.IsAbs(source) {
+		localDir := filepath.Join(layoutDir, source)
+		if info, err := os.Stat(localDir); err == nil && info.IsDir() {
+			return localDir, false, func() {}, nil
+		}
+	}
+	_, url := resolveSource(config, source)
+	dir, cleanup, err := fetchLayout(ctx, config, source)
+	return dir, url != "", cleanup, err
+}
+
+// delimiters with defaults for not defined parts.
+func (d Delimiters) orDefault() Delimiters {
+	if d.Open == "" {
+		d.Open = "{{"
+	}
+	if d.Close == "" {
+		d.Close = "}}"
+	}
+	return d
+}
+
+func (d Delimiters) String() string {
+	return d.Open + " " + d.Close
+}
+
+// merge overlay manifest on top of the current one and return new manifest.
+// Informational fields, delimiters, and git init replaced if set in overlay. Prompts with the same variable replaced in place,
+// rest of prompts, defaults, computed, assertions, hooks, and files rules (including ignores and engines) appended after current. Generators with the same name replaced.
+func (m *Manifest) merge(overlay *Manifest) *Manifest {
+	cp := *m
+	if overlay.Version != "" {
+		cp.Version = overlay.Version
+	}
+	if overlay.Title != "" {
+		cp.Title = overlay.Title
+	}
+	if overlay.Description != "" {
+		cp.Description = overlay.Description
+	}
+	if overlay.Delimiters.Open != "" {
+		cp.Delimiters.Open = overlay.Delimiters.Open
+	}
+	if overlay.Delimiters.Close != "" {
+		cp.Delimiters.Close = overlay.Delimiters.Close
+	}
+	if overlay.GitInit != nil {
+		cp.GitInit = overlay.GitInit
+	}
+	cp.Extends = nil
+	cp.Prompts = mergePrompts(m.Prompts, overlay.Prompts)
+	cp.Default = append(append([]Default{}, m.Default...), overlay.Default...)
+	cp.Computed = append(append([]Computed{}, m.Computed...), overlay.Computed...)
+	cp.Assert = append(append([]Assert{}, m.Assert...), overlay.Assert...)
+	cp.Init = append(append([]Hook{}, m.Init...), overlay.Init...)
+	cp.PostPrompt = append(append([]Hook{}, m.PostPrompt...), overlay.PostPrompt...)
+	cp.Before = append(append([]Hook{}, m.Before...), overlay.Before...)
+	cp.After = append(append([]Hook{}, m.After...), overlay.After...)
+	cp.OnError = append(append([]Hook{}, m.OnError...), overlay.OnError...)
+	cp.Finally = append(append([]Hook{}, m.Finally...), overlay.Finally...)
+	cp.Ignore = append(append([]string{}, m.Ignore...), overlay.Ignore...)
+	cp.Files = append(append([]FileRule{}, m.Files...), overlay.Files...)
+	cp.CopyOnly = append(append([]string{}, m.CopyOnly...), overlay.CopyOnly...)
+	cp.NoRename = append(append([]string{}, m.NoRename...), overlay.NoRename...)
+	cp.Chmod = append(append(ChmodRules{}, m.Chmod...), overlay.Chmod...)
+	cp.Engines = append(append(EngineRules{}, m.Engines...), overlay.Engines...)
+	cp.Generators = mergeGenerators(m.Generators, overlay.Generators)
+	cp.remotes = append(append([]string{}, m.remotes...), overlay.remotes...)
+	return &cp
+}
+
+func mergeGenerators(base, overlay []Generator) []Generator {
+	var ans = append([]Generator{}, base...)
+	for _, gen := range overlay {
+		idx := -1
+		for i, existing := range ans {
+			if existing.Name == gen.Name {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			ans = append(ans, gen)
+		} else {
+			ans[idx] = gen
+		}
+	}
+	return ans
+}
+
+func mergePrompts(base, overlay []Prompt) []Prompt {
+	var ans = append([]Prompt{}, base...)
+	for _, prompt := range overlay {
+		idx := -1
+		for i, existing := range ans {
+			if prompt.Var != "" && existing.Var == prompt.Var {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			ans = append(ans, prompt)
+		} else {
+			ans[idx] = prompt
+		}
+	}
+	return ans
+}
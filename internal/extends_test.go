@@ -0,0 +1,193 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/reddec/layout/internal/gitclient"
+	"github.com/reddec/layout/internal/ui/simple"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtends(t *testing.T) {
+	source := createDir(map[string]string{
+		"base/layout.yaml": `
+title: base
+prompts:
+  - var: name
+  - var: license
+    default: MIT
+computed:
+  - var: greeting
+    value: "hello {{.name}}"
+after:
+  - run: echo -n base >> hooks.txt
+`,
+		"base/content/LICENSE":   "{{.license}}",
+		"base/content/README.md": "base readme",
+		"child/layout.yaml": `
+title: child
+extends:
+  - ../base
+prompts:
+  - var: license
+    default: Apache-2.0
+after:
+  - run: echo -n " child" >> hooks.txt
+`,
+		"child/content/README.md": "{{.greeting}}",
+	})
+	defer os.RemoveAll(source)
+
+	dest, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	err = Deploy(context.Background(), Config{
+		Source: filepath.Join(source, "child"),
+		Target: dest,
+		Display: simple.New(bufio.NewReader(strings.NewReader(
+			"alice\n\n",
+		)), io.Discard),
+		AskOnce: true,
+	})
+	require.NoError(t, err)
+
+	requireContent(t, "hello alice", filepath.Join(dest, "README.md"))
+	requireContent(t, "Apache-2.0", filepath.Join(dest, "LICENSE"))
+	requireContent(t, "base child", filepath.Join(dest, "hooks.txt"))
+}
+
+func TestManifest_merge(t *testing.T) {
+	base := &Manifest{
+		Title:   "base",
+		Prompts: []Prompt{{Var: "a"}, {Var: "b", Default: "base"}},
+		Ignore:  []string{"*.png"},
+	}
+	overlay := &Manifest{
+		Prompts: []Prompt{{Var: "b", Default: "overlay"}, {Var: "c"}},
+		Ignore:  []string{"*.jpg"},
+	}
+	merged := base.merge(overlay)
+	assert.Equal(t, "base", merged.Title)
+	assert.Equal(t, []Prompt{{Var: "a"}, {Var: "b", Default: "overlay"}, {Var: "c"}}, merged.Prompts)
+	assert.Equal(t, []string{"*.png", "*.jpg"}, merged.Ignore)
+	assert.Len(t, base.Prompts, 2, "base should not be modified")
+}
+
+func TestExtendsRemoteTrust(t *testing.T) {
+	base := createGitRepo(t, map[string]string{
+		"layout.yaml": `
+after:
+  - run: echo -n base > hooks.txt
+`,
+		"content/README.md": "base readme",
+	})
+	defer os.RemoveAll(base)
+	child := createDir(map[string]string{
+		"layout.yaml": "extends: [\"file://" + base + "\"]",
+	})
+	defer os.RemoveAll(child)
+
+	t.Run("untrusted remote base", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "project")
+		err := Deploy(context.Background(), Config{Source: child, Target: dest, Git: gitclient.Embedded, NoInput: true})
+		require.ErrorIs(t, err, ErrUntrusted)
+		require.NoDirExists(t, dest)
+	})
+
+	t.Run("trusted remote base", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "project")
+		err := Deploy(context.Background(), Config{Source: child, Target: dest, Git: gitclient.Embedded, NoInput: true, Trusted: []string{"file://" + base}})
+		require.NoError(t, err)
+		requireContent(t, "base", filepath.Join(dest, "hooks.txt"))
+	})
+
+	t.Run("layout test requires trust", func(t *testing.T) {
+		layoutDir := createDir(map[string]string{
+			"layout.yaml":                    "extends: [\"file://" + base + "\"]",
+			"tests/basic/test.yaml":          "",
+			"tests/basic/expected/README.md": "base readme",
+			"tests/basic/expected/hooks.txt": "base",
+		})
+		defer os.RemoveAll(layoutDir)
+
+		results, err := Test(context.Background(), TestConfig{Source: layoutDir})
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		require.ErrorIs(t, results[0].Err, ErrUntrusted)
+
+		for _, config := range []TestConfig{
+			{Source: layoutDir, Trusted: []string{"file://" + base}},
+			{Source: layoutDir, Yes: true},
+		} {
+			results, err = Test(context.Background(), config)
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			require.True(t, results[0].Ok(), "%v %v", results[0].Err, results[0].Differences)
+		}
+	})
+}
+
+// create git repository with committed files.
+func createGitRepo(t *testing.T, content map[string]string) string {
+	dir := createDir(content)
+	repo, err := git.PlainInit(dir, false)
+	require.NoError(t, err)
+	w, err := repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, w.AddWithOptions(&git.AddOptions{All: true}))
+	_, err = w.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "Demo", Email: "demo@example.com", When: time.Now()},
+	})
+	require.NoError(t, err)
+	return dir
+}
+
+func TestComposeSkipsGit(t *testing.T) {
+	source := createDir(map[string]string{
+		"base/layout.yaml":        "title: base",
+		"base/.git/HEAD":          "ref: refs/heads/main",
+		"base/content/README.md":  "base",
+		"child/layout.yaml":       "extends: [../base]",
+		"child/.git/HEAD":         "ref: refs/heads/main",
+		"child/content/child.txt": "child",
+	})
+	defer os.RemoveAll(source)
+
+	manifest, err := loadManifest(filepath.Join(source, "child", "layout.yaml"))
+	require.NoError(t, err)
+	_, dir, cleanup, err := manifest.compose(context.Background(), Config{}, filepath.Join(source, "child"), 0)
+	require.NoError(t, err)
+	defer cleanup()
+
+	require.FileExists(t, filepath.Join(dir, "content", "README.md"))
+	require.FileExists(t, filepath.Join(dir, "content", "child.txt"))
+	require.NoDirExists(t, filepath.Join(dir, ".git"))
+}
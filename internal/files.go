@@ -0,0 +1,270 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	LayoutIgnoreFile  = ".layoutignore" // file in layout root with gitignore-style patterns of content files to skip
+	copyOnlyDirective = "copy-only:"    // prefix of line in ignore file for patterns which should be copied without rendering
+	binarySniffLen    = 8000            // same as git uses to detect binary files
+)
+
+// creates path mapper for CopyTree based on files rules. All conditions of matched rules should return true to copy
+// file or directory. Rename from the first matched rule (with non-empty rename) is used as destination path. Rename
+// applied only to the path matched by glob itself: children of matched directory are moved together with parent.
+func filesMapper(ctx context.Context, rules []FileRule, renderer *renderContext) PathMapper {
+	return func(relPath string, info fs.FileInfo) (string, error) {
+		target := relPath
+		renamed := false
+		for i, rule := range rules {
+			if !rule.match(relPath, info.IsDir()) {
+				continue
+			}
+			include, err := rule.When.Ok(ctx, renderer.State())
+			if err != nil {
+				return "", fmt.Errorf("evaluate condition of rule #%d (%s): %w", i, rule.Glob, err)
+			}
+			if !include {
+				return "", nil
+			}
+			if rule.Rename == "" || renamed || rule.matchedByParent(relPath) {
+				continue
+			}
+			newPath, err := renderer.Render(rule.Rename)
+			if err != nil {
+				return "", fmt.Errorf("render rename of rule #%d (%s): %w", i, rule.Glob, err)
+			}
+			newPath = strings.TrimPrefix(path.Clean("/"+newPath), "/")
+			if newPath == "" {
+				// renamed to nothing, mimic behaviour of empty names
+				return "", nil
+			}
+			target = newPath
+			renamed = true
+		}
+		return target, nil
+	}
+}
+
+// creates path mapper for CopyTree which skips files and directories matched by patterns.
+func ignoreMapper(patterns []string) PathMapper {
+	matcher := newGlobMatcher(patterns)
+	return func(relPath string, info fs.FileInfo) (string, error) {
+		if matcher.Match(relPath, info.IsDir()) {
+			return "", nil
+		}
+		return relPath, nil
+	}
+}
+
+// load ignore file with gitignore-style patterns. Lines with copy-only directive returned separately.
+// Returns empty lists if file not exists.
+func loadIgnoreFile(file string) (ignore []string, copyOnly []string, err error) {
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if pattern := strings.TrimPrefix(line, copyOnlyDirective); pattern != line {
+			copyOnly = append(copyOnly, strings.TrimSpace(pattern))
+		} else {
+			ignore = append(ignore, line)
+		}
+	}
+	return ignore, copyOnly, nil
+}
+
+// match relative (slash-separated) path against rule glob.
+func (fr FileRule) match(relPath string, isDir bool) bool {
+	return newGlobMatcher([]string{fr.Glob}).Match(relPath, isDir)
+}
+
+// checks that path matched by rule only because one of its parent directories matched.
+func (fr FileRule) matchedByParent(relPath string) bool {
+	parent := path.Dir(relPath)
+	return parent != "." && parent != "/" && fr.match(parent, true)
+}
+
+// globMatcher matches relative (slash-separated) paths against list of gitignore-style patterns: `**` matches any
+// number of directories, `!` negates pattern, trailing `/` matches only directories, and pattern without `/` matches
+// name on any level. The last matched pattern wins. Matched directory matches all children too.
+type globMatcher struct {
+	matcher gitignore.Matcher
+}
+
+func newGlobMatcher(patterns []string) *globMatcher {
+	var list = make([]gitignore.Pattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		list = append(list, gitignore.ParsePattern(pattern, nil))
+	}
+	return &globMatcher{matcher: gitignore.NewMatcher(list)}
+}
+
+// Match relative (slash-separated) path. Empty path never matches.
+func (gm *globMatcher) Match(relPath string, isDir bool) bool {
+	relPath = strings.Trim(path.Clean("/"+relPath), "/")
+	if relPath == "" {
+		return false
+	}
+	return gm.matcher.Match(strings.Split(relPath, "/"), isDir)
+}
+
+// detects binary content: NUL bytes or non-text content type in first bytes.
+func isBinary(data []byte) bool {
+	if len(data) > binarySniffLen {
+		data = data[:binarySniffLen]
+	}
+	if bytes.IndexByte(data, 0) != -1 {
+		return true
+	}
+	return !strings.HasPrefix(http.DetectContentType(data), "text/")
+}
+
+// render content of file (or target of symlink) as template in place. Mode of file preserved, binary files skipped.
+func renderFile(engine Engine, state map[string]interface{}, file string) error {
+	info, err := os.Lstat(file)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(file)
+		if err != nil {
+			return fmt.Errorf("read link: %w", err)
+		}
+		newTarget, err := engine.Render(target, state)
+		if err != nil {
+			return fmt.Errorf("render link target: %w", err)
+		}
+		if newTarget == target {
+			return nil
+		}
+		if err := os.Remove(file); err != nil {
+			return fmt.Errorf("remove old link: %w", err)
+		}
+		return os.Symlink(newTarget, file)
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("read content: %w", err)
+	}
+	if isBinary(content) {
+		return nil
+	}
+	data, err := engine.Render(string(content), state)
+	if err != nil {
+		return err
+	}
+	if data == string(content) {
+		return nil
+	}
+	return writeFile(file, []byte(data), info.Mode())
+}
+
+// write content to existing file and keep mode, even if file is read-only.
+func writeFile(file string, data []byte, mode os.FileMode) error {
+	if mode&0200 == 0 {
+		if err := os.Chmod(file, mode|0200); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(file, data, mode); err != nil {
+		return err
+	}
+	return os.Chmod(file, mode)
+}
+
+// UnmarshalYAML decodes mapping of globs to octal modes keeping definition order.
+func (cr *ChmodRules) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: chmod should be mapping of glob to mode", value.Line)
+	}
+	var rules ChmodRules
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key, val := value.Content[i], value.Content[i+1]
+		mode, err := strconv.ParseUint(strings.TrimPrefix(val.Value, "0o"), 8, 32)
+		if err != nil {
+			return fmt.Errorf("line %d: parse mode %q of %s: %w", val.Line, val.Value, key.Value, err)
+		}
+		rules = append(rules, ChmodRule{Glob: key.Value, Mode: os.FileMode(mode)})
+	}
+	*cr = rules
+	return nil
+}
+
+// apply modes to files and directories in tree. Glob matched against path relative to root dir.
+func (cr ChmodRules) apply(tree *FSTree, rootDir string) error {
+	if len(cr) == 0 {
+		return nil
+	}
+	var matchers = make([]*globMatcher, 0, len(cr))
+	for _, rule := range cr {
+		matchers = append(matchers, newGlobMatcher([]string{rule.Glob}))
+	}
+	var visit func(node *FSTree) error
+	visit = func(node *FSTree) error {
+		for _, child := range node.Children {
+			if err := visit(child); err != nil {
+				return err
+			}
+		}
+		if node.parent == nil {
+			return nil
+		}
+		file := node.Path()
+		relPath, err := filepath.Rel(rootDir, file)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Lstat(file); err != nil {
+			return err
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			return nil // mode of symlink can not be changed, and we should not change mode of target
+		}
+		for i := len(cr) - 1; i >= 0; i-- {
+			if matchers[i].Match(filepath.ToSlash(relPath), node.Dir) {
+				return os.Chmod(file, cr[i].Mode)
+			}
+		}
+		return nil
+	}
+	return visit(tree)
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilesRules(t *testing.T) {
+	source := createDir(map[string]string{
+		"docker/Dockerfile":  "FROM scratch",
+		"docker/compose.yml": "services: {}",
+		"http/server.go":     "package http",
+		"ci/github.yml":      "on: push",
+		"README.md":          "readme",
+	})
+	defer os.RemoveAll(source)
+
+	dest, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	renderer := newRenderContext(map[string]interface{}{
+		"docker":   false,
+		"features": []string{"http"},
+		"ci":       "gitlab",
+	})
+	rules := []FileRule{
+		{Glob: "docker", When: "docker"},
+		{Glob: "http", When: `has(features, "http")`},
+		{Glob: "ci/github.yml", Rename: ".{{.ci}}-ci.yml"},
+	}
+
+	tree, err := CopyTree(source, dest, filesMapper(context.Background(), rules, renderer))
+	require.NoError(t, err)
+
+	assert.NoDirExists(t, filepath.Join(dest, "docker"))
+	assert.FileExists(t, filepath.Join(dest, "http", "server.go"))
+	assert.FileExists(t, filepath.Join(dest, "README.md"))
+	assert.FileExists(t, filepath.Join(dest, ".gitlab-ci.yml"))
+	assert.NoFileExists(t, filepath.Join(dest, "ci", "github.yml"))
+	assert.Contains(t, tree.Paths(), filepath.Join(dest, ".gitlab-ci.yml"))
+	assert.NotContains(t, tree.Paths(), filepath.Join(dest, "docker"))
+}
+
+func TestCopyTree_renameDir(t *testing.T) {
+	source := createDir(map[string]string{
+		"src/a/b.txt": "b",
+	})
+	defer os.RemoveAll(source)
+
+	dest, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	_, err = CopyTree(source, dest, func(relPath string, _ os.FileInfo) (string, error) {
+		if relPath == "src" {
+			return "pkg/lib", nil
+		}
+		return relPath, nil
+	})
+	require.NoError(t, err)
+	requireContent(t, "b", filepath.Join(dest, "pkg", "lib", "a", "b.txt"))
+	assert.NoDirExists(t, filepath.Join(dest, "src"))
+}
+
+func TestFilesRules_renameDir(t *testing.T) {
+	for _, glob := range []string{"docs", "docs/", "/docs"} {
+		t.Run(glob, func(t *testing.T) {
+			source := createDir(map[string]string{
+				"layout.yaml": `
+prompts:
+  - var: name
+files:
+  - glob: "` + glob + `"
+    rename: "documentation-{{.name}}"
+`,
+				"content/docs/index.md":     "index of {{.name}}",
+				"content/docs/api/usage.md": "usage",
+				"content/README.md":         "readme",
+			})
+			defer os.RemoveAll(source)
+
+			dest, err := os.MkdirTemp("", "")
+			require.NoError(t, err)
+			defer os.RemoveAll(dest)
+
+			err = Deploy(context.Background(), Config{
+				Source:  source,
+				Target:  dest,
+				Answers: map[string]interface{}{"name": "alice"},
+				AskOnce: true,
+			})
+			require.NoError(t, err)
+
+			requireContent(t, "index of alice", filepath.Join(dest, "documentation-alice", "index.md"))
+			requireContent(t, "usage", filepath.Join(dest, "documentation-alice", "api", "usage.md"))
+			requireContent(t, "readme", filepath.Join(dest, "README.md"))
+			assert.NoDirExists(t, filepath.Join(dest, "docs"))
+		})
+	}
+}
+
+func TestCopyOnlyAndNoRename(t *testing.T) {
+	source := createDir(map[string]string{
+		"layout.yaml": `
+prompts:
+  - var: name
+copy_only:
+  - "charts/*"
+no_rename:
+  - "charts"
+`,
+		"content/{{.name}}.txt":                   "hello {{.name}}",
+		"content/image.bin":                       "\x89PNG\r\n\x1a\n\x00\x00{{.name}}",
+		"content/charts/{{ .Release.Name }}.yaml": "name: {{ .Release.Name }}",
+		"content/charts/templates/{{.name}}.yaml": "{{ .Values.name }}",
+	})
+	defer os.RemoveAll(source)
+
+	dest, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	err = Deploy(context.Background(), Config{
+		Source:  source,
+		Target:  dest,
+		Answers: map[string]interface{}{"name": "alice"},
+		AskOnce: true,
+	})
+	require.NoError(t, err)
+
+	requireContent(t, "hello alice", filepath.Join(dest, "alice.txt"))
+	requireContent(t, "\x89PNG\r\n\x1a\n\x00\x00{{.name}}", filepath.Join(dest, "image.bin"))
+	requireContent(t, "name: {{ .Release.Name }}", filepath.Join(dest, "charts", "{{ .Release.Name }}.yaml"))
+	requireContent(t, "{{ .Values.name }}", filepath.Join(dest, "charts", "templates", "{{.name}}.yaml"))
+}
+
+func TestIsBinary(t *testing.T) {
+	assert.False(t, isBinary([]byte("hello {{.world}}")))
+	assert.False(t, isBinary(nil))
+	assert.True(t, isBinary([]byte("abc\x00def")))
+	assert.True(t, isBinary([]byte("GIF89a....")))
+}
+
+func TestGlobMatcher(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		path     string
+		dir      bool
+		match    bool
+	}{
+		{[]string{"**/ignore*"}, "ignore.txt", false, true},
+		{[]string{"**/ignore*"}, "a/b/c/ignore.txt", false, true},
+		{[]string{"*.css"}, "static/css/main.css", false, true},
+		{[]string{"/*.css"}, "static/main.css", false, false},
+		{[]string{"static/**/*.css"}, "static/a/b/main.css", false, true},
+		{[]string{"static"}, "static/main.css", false, true},
+		{[]string{"build/"}, "build", false, false},
+		{[]string{"build/"}, "build", true, true},
+		{[]string{"build/"}, "build/out.bin", false, true},
+		{[]string{"*.css", "!vendor.css"}, "vendor.css", false, false},
+		{[]string{"*.css", "!vendor.css"}, "app.css", false, true},
+		{[]string{"# comment", ""}, "comment", false, false},
+		{nil, "anything", false, false},
+		{[]string{"*"}, "", true, false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, newGlobMatcher(c.patterns).Match(c.path, c.dir), "%v %s", c.patterns, c.path)
+	}
+}
+
+func TestLayoutIgnore(t *testing.T) {
+	source := createDir(map[string]string{
+		"layout.yaml": `
+prompts:
+  - var: name
+`,
+		".layoutignore": `
+# editor files
+.DS_Store
+*.swp
+fixtures/*
+!fixtures/keep.txt
+copy-only: *.tpl
+`,
+		"content/.DS_Store":          "junk",
+		"content/src/main.go.swp":    "junk",
+		"content/fixtures/data.json": "{}",
+		"content/fixtures/keep.txt":  "{{.name}}",
+		"content/src/main.go":        "// {{.name}}",
+		"content/src/page.tpl":       "{{.title}}",
+	})
+	defer os.RemoveAll(source)
+
+	dest, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	err = Deploy(context.Background(), Config{
+		Source:  source,
+		Target:  dest,
+		Answers: map[string]interface{}{"name": "alice"},
+		AskOnce: true,
+	})
+	require.NoError(t, err)
+
+	assert.NoFileExists(t, filepath.Join(dest, ".DS_Store"))
+	assert.NoFileExists(t, filepath.Join(dest, "src", "main.go.swp"))
+	assert.NoFileExists(t, filepath.Join(dest, "fixtures", "data.json"))
+	requireContent(t, "alice", filepath.Join(dest, "fixtures", "keep.txt"))
+	requireContent(t, "// alice", filepath.Join(dest, "src", "main.go"))
+	requireContent(t, "{{.title}}", filepath.Join(dest, "src", "page.tpl"))
+}
+
+func TestModesAndSymlinks(t *testing.T) {
+	source := createDir(map[string]string{
+		"layout.yaml": `
+prompts:
+  - var: name
+chmod:
+  "scripts/*": 0750
+  "scripts/keep.sh": "0700"
+`,
+		"content/{{.name}}.txt":    "hello {{.name}}",
+		"content/run.sh":           "#!/bin/sh",
+		"content/scripts/build.sh": "#!/bin/sh",
+		"content/scripts/keep.sh":  "#!/bin/sh",
+	})
+	defer os.RemoveAll(source)
+	require.NoError(t, os.Chmod(filepath.Join(source, "content", "{{.name}}.txt"), 0640))
+	require.NoError(t, os.Chmod(filepath.Join(source, "content", "run.sh"), 0751))
+	require.NoError(t, os.Symlink("{{.name}}.txt", filepath.Join(source, "content", "link")))
+	require.NoError(t, os.Symlink("missing", filepath.Join(source, "content", "dangling")))
+
+	dest, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	err = Deploy(context.Background(), Config{
+		Source:  source,
+		Target:  dest,
+		Answers: map[string]interface{}{"name": "alice"},
+		AskOnce: true,
+	})
+	require.NoError(t, err)
+
+	requireMode(t, 0640, filepath.Join(dest, "alice.txt"))
+	requireMode(t, 0751, filepath.Join(dest, "run.sh"))
+	requireMode(t, 0750, filepath.Join(dest, "scripts", "build.sh"))
+	requireMode(t, 0700, filepath.Join(dest, "scripts", "keep.sh"))
+
+	target, err := os.Readlink(filepath.Join(dest, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "alice.txt", target)
+	requireContent(t, "hello alice", filepath.Join(dest, "link"))
+
+	target, err = os.Readlink(filepath.Join(dest, "dangling"))
+	require.NoError(t, err)
+	assert.Equal(t, "missing", target)
+}
+
+func requireMode(t *testing.T, expected os.FileMode, fileName string) {
+	info, err := os.Lstat(fileName)
+	require.NoError(t, err)
+	require.Equal(t, expected, info.Mode().Perm(), fileName)
+}
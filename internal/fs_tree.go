@@ -28,6 +28,7 @@ type FSTree struct {
 	Name     string    // path or base name
 	Dir      bool      // is it directory (used to skip rendering content)
 	Children []*FSTree // child nodes (files or dirs)
+	Source   string    // relative (slash-separated) path in source directory, could be empty for root and implicit dirs
 	parent   *FSTree   // ref to parent (could be null for root)
 }
 
@@ -82,7 +83,7 @@ func (fs *FSTree) Render(renderName func(node *FSTree) (string, error)) error {
 	oldPath := fs.Path()
 	fs.Name = newName
 	newPath := fs.Path()
-	if err := os.Rename(oldPath, newPath); err != nil {
+	if err := moveInto(oldPath, newPath); err != nil {
 		return err
 	}
 	// continue walk
@@ -115,6 +116,29 @@ func (fs *FSTree) Path() string {
 	return filepath.Join(fs.parent.Path(), fs.Name)
 }
 
+// move file or directory. In case both source and destination are directories, content of source merged into
+// destination (recursively) and source removed. Existing files are overwritten.
+func moveInto(src, dest string) error {
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	destInfo, err := os.Lstat(dest)
+	if err != nil || !srcInfo.IsDir() || !destInfo.IsDir() {
+		return os.Rename(src, dest)
+	}
+	list, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, item := range list {
+		if err := moveInto(filepath.Join(src, item.Name()), filepath.Join(dest, item.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(src)
+}
+
 func (fs *FSTree) child(name string, dir bool) *FSTree {
 	for _, c := range fs.Children {
 		if c.Name == name {
@@ -0,0 +1,326 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"go/token"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/d5/tengo/v2"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/google/uuid"
+	"golang.org/x/mod/modfile"
+)
+
+//go:embed licenses/*.txt
+var licenses embed.FS
+
+// helpers are scaffolding functions available in templates and in Tengo scripts.
+// Relative paths resolved from work dir (destination directory).
+type helpers struct {
+	workDir string
+}
+
+func (h helpers) funcs() map[string]interface{} {
+	return map[string]interface{}{
+		"goIdent":        goIdent,
+		"pascalCase":     pascalCase,
+		"kebabCase":      kebabCase,
+		"screamingSnake": screamingSnake,
+		"goModulePath":   h.goModulePath,
+		"gitConfig":      h.gitConfig,
+		"uuidv5":         uuidv5,
+		"licenseText":    licenseText,
+		"readFile":       h.readFile,
+		"fileExists":     h.fileExists,
+	}
+}
+
+func (h helpers) templateFuncs() template.FuncMap {
+	return h.funcs()
+}
+
+// tengoFuncs returns helpers wrapped as Tengo functions. Only string arguments are supported.
+func (h helpers) tengoFuncs() map[string]tengo.Object {
+	var ans = make(map[string]tengo.Object)
+	for name, fn := range h.funcs() {
+		ans[name] = &tengo.UserFunction{Name: name, Value: tengoAdapter(fn)}
+	}
+	return ans
+}
+
+// wraps Go function with string arguments and single result (plus optional error) to Tengo function.
+func tengoAdapter(fn interface{}) tengo.CallableFunc {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	return func(args ...tengo.Object) (tengo.Object, error) {
+		if len(args) != t.NumIn() {
+			return nil, tengo.ErrWrongNumArguments
+		}
+		var in = make([]reflect.Value, 0, len(args))
+		for i, arg := range args {
+			s, ok := tengo.ToString(arg)
+			if !ok {
+				return nil, tengo.ErrInvalidArgumentType{Name: fmt.Sprint(i), Expected: "string", Found: arg.TypeName()}
+			}
+			in = append(in, reflect.ValueOf(s))
+		}
+		out := v.Call(in)
+		if len(out) == 2 && !out[1].IsNil() {
+			return nil, out[1].Interface().(error)
+		}
+		if list, ok := out[0].Interface().([]string); ok {
+			var arr = make([]interface{}, 0, len(list))
+			for _, item := range list {
+				arr = append(arr, item)
+			}
+			return tengo.FromInterface(arr)
+		}
+		return tengo.FromInterface(out[0].Interface())
+	}
+}
+
+// split value to words by non-alphanumeric characters and by case changes: HTTPServer_v2 -> HTTP, Server, v2.
+func splitWords(value string) []string {
+	var words []string
+	var current []rune
+	runes := []rune(value)
+	flush := func() {
+		if len(current) > 0 {
+			words = append(words, string(current))
+			current = nil
+		}
+	}
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			flush()
+			continue
+		}
+		if unicode.IsUpper(r) && len(current) > 0 {
+			prev := current[len(current)-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				flush()
+			}
+		}
+		current = append(current, r)
+	}
+	flush()
+	return words
+}
+
+func capitalize(word string) string {
+	runes := []rune(strings.ToLower(word))
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
+
+// pascalCase converts value to PascalCase: my-project -> MyProject.
+func pascalCase(value string) string {
+	var sb strings.Builder
+	for _, w := range splitWords(value) {
+		sb.WriteString(capitalize(w))
+	}
+	return sb.String()
+}
+
+// kebabCase converts value to kebab-case: MyProject -> my-project.
+func kebabCase(value string) string {
+	return strings.ToLower(strings.Join(splitWords(value), "-"))
+}
+
+// screamingSnake converts value to SCREAMING_SNAKE_CASE: my-project -> MY_PROJECT.
+func screamingSnake(value string) string {
+	return strings.ToUpper(strings.Join(splitWords(value), "_"))
+}
+
+// goIdent converts value to valid unexported Go identifier in camelCase: my-project -> myProject, 1st -> _1st, type -> type_.
+func goIdent(value string) string {
+	words := splitWords(value)
+	if len(words) == 0 {
+		return "_"
+	}
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(words[0]))
+	for _, w := range words[1:] {
+		sb.WriteString(capitalize(w))
+	}
+	ident := sb.String()
+	if unicode.IsDigit([]rune(ident)[0]) {
+		ident = "_" + ident
+	}
+	if token.Lookup(ident).IsKeyword() {
+		ident += "_"
+	}
+	return ident
+}
+
+// uuidv5 generates name-based (SHA1) UUID. Namespace is UUID or one of predefined: dns, url, oid, x500.
+func uuidv5(namespace string, name string) (string, error) {
+	var ns uuid.UUID
+	switch strings.ToLower(namespace) {
+	case "dns":
+		ns = uuid.NameSpaceDNS
+	case "url":
+		ns = uuid.NameSpaceURL
+	case "oid":
+		ns = uuid.NameSpaceOID
+	case "x500":
+		ns = uuid.NameSpaceX500
+	default:
+		v, err := uuid.Parse(namespace)
+		if err != nil {
+			return "", fmt.Errorf("parse namespace: %w", err)
+		}
+		ns = v
+	}
+	return uuid.NewSHA1(ns, []byte(name)).String(), nil
+}
+
+// licenseText returns text of license by SPDX identifier (case-insensitive, -only and -or-later suffixes ignored).
+func licenseText(id string) (string, error) {
+	name := strings.TrimSuffix(strings.TrimSuffix(id, "-only"), "-or-later")
+	list, err := fs.ReadDir(licenses, "licenses")
+	if err != nil {
+		return "", err
+	}
+	var known []string
+	for _, item := range list {
+		spdx := strings.TrimSuffix(item.Name(), ".txt")
+		if strings.EqualFold(spdx, name) {
+			data, err := licenses.ReadFile(path.Join("licenses", item.Name()))
+			return string(data), err
+		}
+		known = append(known, spdx)
+	}
+	sort.Strings(known)
+	return "", fmt.Errorf("unknown license %q, available: %s", id, strings.Join(known, ", "))
+}
+
+// goModulePath returns module path from the nearest go.mod in work dir or any of parent directories.
+func (h helpers) goModulePath() (string, error) {
+	file, err := findRootFile(h.workDir)("go.mod")
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	modPath := modfile.ModulePath(data)
+	if modPath == "" {
+		return "", fmt.Errorf("module path not defined in %s", file)
+	}
+	return modPath, nil
+}
+
+// gitConfig returns value of git configuration key (section[.subsection].name) from repository config (if work dir
+// is inside repository), then from global and system configs. Returns empty string if key is not defined.
+func (h helpers) gitConfig(key string) (string, error) {
+	idx, lastIdx := strings.Index(key, "."), strings.LastIndex(key, ".")
+	if idx == -1 {
+		return "", fmt.Errorf("key should be in format section[.subsection].name")
+	}
+	section, subsection, name := key[:idx], "", key[lastIdx+1:]
+	if idx != lastIdx {
+		subsection = key[idx+1 : lastIdx]
+	}
+
+	var configs []*config.Config
+	if repo, err := git.PlainOpenWithOptions(h.workDir, &git.PlainOpenOptions{DetectDotGit: true}); err == nil {
+		local, err := repo.Config()
+		if err != nil {
+			return "", fmt.Errorf("read repository config: %w", err)
+		}
+		configs = append(configs, local)
+	} else if !errors.Is(err, git.ErrRepositoryNotExists) {
+		return "", fmt.Errorf("open repository: %w", err)
+	}
+	for _, scope := range []config.Scope{config.GlobalScope, config.SystemScope} {
+		cfg, err := config.LoadConfig(scope)
+		if err != nil {
+			return "", fmt.Errorf("read config: %w", err)
+		}
+		configs = append(configs, cfg)
+	}
+
+	for _, cfg := range configs {
+		if cfg.Raw == nil || !cfg.Raw.HasSection(section) {
+			continue
+		}
+		options := cfg.Raw.Section(section).Options
+		if subsection != "" {
+			sec := cfg.Raw.Section(section)
+			if !sec.HasSubsection(subsection) {
+				continue
+			}
+			options = sec.Subsection(subsection).Options
+		}
+		if options.Has(name) {
+			return options.Get(name), nil
+		}
+	}
+	return "", nil
+}
+
+// readFile returns content of file. Relative path resolved from work dir.
+func (h helpers) readFile(file string) (string, error) {
+	data, err := os.ReadFile(h.path(file))
+	return string(data), err
+}
+
+// fileExists returns true if file or directory exists. Relative path resolved from work dir.
+func (h helpers) fileExists(file string) bool {
+	_, err := os.Stat(h.path(file))
+	return err == nil
+}
+
+func (h helpers) path(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(h.workDir, file)
+}
+
+type workDirKey struct{}
+
+// withWorkDir returns context with directory which will be used as work dir by helpers in Tengo scripts.
+func withWorkDir(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, workDirKey{}, dir)
+}
+
+// helpers bound to work dir from context, or to current directory.
+func helpersFrom(ctx context.Context) helpers {
+	if dir, ok := ctx.Value(workDirKey{}).(string); ok {
+		return helpers{workDir: dir}
+	}
+	dir, _ := os.Getwd()
+	return helpers{workDir: dir}
+}
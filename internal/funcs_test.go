@@ -0,0 +1,128 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaseHelpers(t *testing.T) {
+	cases := []struct {
+		value  string
+		ident  string
+		pascal string
+		kebab  string
+		snake  string
+	}{
+		{"my-project", "myProject", "MyProject", "my-project", "MY_PROJECT"},
+		{"HTTPServer_v2", "httpServerV2", "HttpServerV2", "http-server-v2", "HTTP_SERVER_V2"},
+		{"hello world", "helloWorld", "HelloWorld", "hello-world", "HELLO_WORLD"},
+		{"camelCase", "camelCase", "CamelCase", "camel-case", "CAMEL_CASE"},
+		{"1st place", "_1stPlace", "1stPlace", "1st-place", "1ST_PLACE"},
+		{"type", "type_", "Type", "type", "TYPE"},
+		{"--", "_", "", "", ""},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.ident, goIdent(c.value), c.value)
+		assert.Equal(t, c.pascal, pascalCase(c.value), c.value)
+		assert.Equal(t, c.kebab, kebabCase(c.value), c.value)
+		assert.Equal(t, c.snake, screamingSnake(c.value), c.value)
+	}
+}
+
+func TestUUIDv5(t *testing.T) {
+	v, err := uuidv5("dns", "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "cfbff0d1-9375-5685-968c-48ce8b15ae17", v)
+
+	v2, err := uuidv5("6ba7b810-9dad-11d1-80b4-00c04fd430c8", "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, v, v2)
+
+	_, err = uuidv5("bad", "example.com")
+	assert.Error(t, err)
+}
+
+func TestLicenseText(t *testing.T) {
+	text, err := licenseText("mit")
+	require.NoError(t, err)
+	assert.Contains(t, text, "MIT License")
+
+	text, err = licenseText("GPL-3.0-or-later")
+	require.NoError(t, err)
+	assert.Contains(t, text, "GNU GENERAL PUBLIC LICENSE")
+
+	_, err = licenseText("WTFPL")
+	assert.ErrorContains(t, err, "Apache-2.0")
+}
+
+func TestPathHelpers(t *testing.T) {
+	dir := createDir(map[string]string{
+		"go.mod":      "module example.com/foo\n\ngo 1.18\n",
+		"sub/foo.txt": "hello",
+	})
+	defer os.RemoveAll(dir)
+
+	repo, err := git.PlainInit(dir, false)
+	require.NoError(t, err)
+	cfg, err := repo.Config()
+	require.NoError(t, err)
+	cfg.Raw.Section("user").SetOption("name", "Alice")
+	cfg.Raw.Section("layout").Subsection("sub.section").SetOption("key", "value")
+	require.NoError(t, repo.SetConfig(cfg))
+
+	h := helpers{workDir: filepath.Join(dir, "sub")}
+
+	modPath, err := h.goModulePath()
+	require.NoError(t, err)
+	assert.Equal(t, "example.com/foo", modPath)
+
+	name, err := h.gitConfig("user.name")
+	require.NoError(t, err)
+	assert.Equal(t, "Alice", name)
+
+	sub, err := h.gitConfig("layout.sub.section.key")
+	require.NoError(t, err)
+	assert.Equal(t, "value", sub)
+
+	content, err := h.readFile("foo.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", content)
+	assert.True(t, h.fileExists("foo.txt"))
+	assert.False(t, h.fileExists("bar.txt"))
+
+	t.Run("templates", func(t *testing.T) {
+		r := newRenderContext(map[string]interface{}{"name": "my-app"}).WorkDir(h.workDir)
+		v, err := r.Render(`{{goModulePath}}/{{kebabCase .name}} {{gitConfig "user.name"}} {{readFile "foo.txt"}}`)
+		require.NoError(t, err)
+		assert.Equal(t, "example.com/foo/my-app Alice hello", v)
+	})
+
+	t.Run("tengo", func(t *testing.T) {
+		ctx := withWorkDir(context.Background(), h.workDir)
+		ok, err := Condition(`fileExists("foo.txt") && pascalCase(name) == "MyApp" && gitConfig("user.name") == "Alice"`).Eval(ctx, map[string]interface{}{"name": "my-app"})
+		require.NoError(t, err)
+		assert.True(t, ok)
+	})
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	AnswersFile   = ".layout-answers.yaml" // file in generated project with source of layout and answers
+	GeneratorsDir = "generators"           // default parent directory for generators in layout
+)
+
+// Answers stored in generated project and used by generators.
+type Answers struct {
+	Source string                 `yaml:"source"`        // layout source as it was used for deploy
+	Dir    string                 `yaml:"dir,omitempty"` // relative path to layout in source (for multi-layouts repo)
+	Values map[string]interface{} `yaml:"values"`        // final state except magic variables
+}
+
+// GenerateConfig of generator invocation. Config.Target should point to previously generated project (or any
+// directory inside it). If Config.Source is empty, source from stored answers will be used.
+type GenerateConfig struct {
+	Config
+	Generator string   // generator name
+	Args      []string // positional arguments, mapped to generator's args
+}
+
+func newAnswers(source string, dir string, state map[string]interface{}) *Answers {
+	if info, err := os.Stat(source); err == nil && info.IsDir() {
+		// local directories should be resolvable from any location
+		if abs, err := filepath.Abs(source); err == nil {
+			source = abs
+		}
+	}
+	answers := Answers{
+		Source: source,
+		Dir:    filepath.ToSlash(dir),
+	}
+	return answers.withValues(state)
+}
+
+// copy of answers with values from state (except magic variables).
+func (a Answers) withValues(state map[string]interface{}) *Answers {
+	values := make(map[string]interface{}, len(state))
+	for k, v := range state {
+		values[k] = v
+	}
+	delete(values, MagicVarDir)
+	a.Values = values
+	return &a
+}
+
+func loadAnswers(file string) (*Answers, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var a Answers
+	return &a, yaml.NewDecoder(f).Decode(&a)
+}
+
+func (a *Answers) save(file string) error {
+	data, err := yaml.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("marshal answers: %w", err)
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+// Generate applies named generator from layout to previously generated project. Project root is detected by
+// answers file in target directory or in any of parent directories. Stored answers used as initial state and as
+// default values for generator prompts. Generator inherits partials, engines, and delimiters (if not defined) of
+// layout. Answers file updated by values of generator.
+func Generate(ctx context.Context, config GenerateConfig) error {
+	config.Config = config.Config.withDefaults(ctx)
+
+	targetDir, err := filepath.Abs(config.Target)
+	if err != nil {
+		return fmt.Errorf("calculate abs path: %w", err)
+	}
+
+	answersFile, err := findRootFile(targetDir)(AnswersFile)
+	if err != nil {
+		return fmt.Errorf("find %s (is it generated project?): %w", AnswersFile, err)
+	}
+	projectRoot := filepath.Dir(answersFile)
+
+	answers, err := loadAnswers(answersFile)
+	if err != nil {
+		return fmt.Errorf("load answers: %w", err)
+	}
+
+	source := config.Source
+	if source == "" {
+		source = answers.Source
+	}
+
+	sourceDir, cleanup, err := fetchLayout(ctx, config.Config, source)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	layoutDir := filepath.Join(sourceDir, path.Clean("/"+answers.Dir))
+	manifestFile := filepath.Join(layoutDir, ManifestFile)
+	manifest, err := loadManifest(manifestFile)
+	if err != nil {
+		return fmt.Errorf("load manifest %s: %w", manifestFile, err)
+	}
+
+	if ok, err := manifest.isSupportedVersion(config.Version); err != nil {
+		return fmt.Errorf("check manifest version: %w", err)
+	} else if !ok {
+		return fmt.Errorf("manifest version constraint (%s) requires another version of application (current %s)", manifest.Version, config.Version)
+	}
+
+	manifest, layoutDir, cleanupComposed, err := manifest.compose(ctx, config.Config, layoutDir, 0)
+	if err != nil {
+		return fmt.Errorf("compose layout: %w", err)
+	}
+	defer cleanupComposed()
+
+	generator, err := manifest.generator(config.Generator)
+	if err != nil {
+		return err
+	}
+
+	if len(config.Args) > len(generator.Args) {
+		return fmt.Errorf("generator %s accepts maximum %d arguments, got %d", generator.Name, len(generator.Args), len(config.Args))
+	}
+
+	renderConfig := config.Config
+	renderConfig.Defaults = mergeValues(config.Defaults, answers.Values)
+	renderConfig.Answers = make(map[string]interface{}, len(config.Answers)+len(config.Args))
+	for k, v := range config.Answers {
+		renderConfig.Answers[k] = v
+	}
+	for i, arg := range config.Args {
+		renderConfig.Answers[generator.Args[i]] = arg
+	}
+
+	gen := generator.withDefaults(answers.Values).inherit(manifest, layoutDir)
+	if err := confirmHooks(ctx, config.Config, append([]string{source}, manifest.remotes...), gen.hooks()); err != nil {
+		return err
+	}
+	_, err = gen.renderTo(ctx, renderConfig, projectRoot, filepath.Join(layoutDir, generator.dir()), answers)
+	if err != nil {
+		return fmt.Errorf("render generator %s: %w", generator.Name, err)
+	}
+	return nil
+}
+
+// find generator by name.
+func (m *Manifest) generator(name string) (*Generator, error) {
+	for i := range m.Generators {
+		if m.Generators[i].Name == name {
+			return &m.Generators[i], nil
+		}
+	}
+	var names []string
+	for _, g := range m.Generators {
+		names = append(names, g.Name)
+	}
+	return nil, fmt.Errorf("unknown generator %q, available: %v", name, names)
+}
+
+// directory of generator relative to layout.
+func (g *Generator) dir() string {
+	if g.Dir != "" {
+		return path.Clean("/" + g.Dir)
+	}
+	return path.Join(GeneratorsDir, g.Name)
+}
+
+// copy generator manifest where default values of top-level prompts replaced by stored values (if defined).
+func (g *Generator) withDefaults(values map[string]interface{}) *Manifest {
+	cp := g.Manifest
+	cp.Prompts = make([]Prompt, 0, len(g.Prompts))
+	for _, p := range g.Prompts {
+		if v, ok := values[p.Var]; ok && p.Var != "" {
+			p.Default = v
+		}
+		cp.Prompts = append(cp.Prompts, p)
+	}
+	return &cp
+}
+
+// copy of generator manifest with partials, engines, and delimiters (if not defined) of layout. Engines and partials
+// of generator have priority.
+func (m *Manifest) inherit(layout *Manifest, layoutDir string) *Manifest {
+	cp := *m
+	if cp.Delimiters.Open == "" {
+		cp.Delimiters.Open = layout.Delimiters.Open
+	}
+	if cp.Delimiters.Close == "" {
+		cp.Delimiters.Close = layout.Delimiters.Close
+	}
+	cp.Engines = append(append(EngineRules{}, layout.Engines...), m.Engines...)
+	cp.partials = append(append([]string{}, layout.partials...), filepath.Join(layoutDir, PartialsDir))
+	return &cp
+}
+
+func mergeValues(src, overlay map[string]interface{}) map[string]interface{} {
+	ans := make(map[string]interface{}, len(src)+len(overlay))
+	for k, v := range src {
+		ans[k] = v
+	}
+	for k, v := range overlay {
+		ans[k] = v
+	}
+	return ans
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/reddec/layout/internal/ui/simple"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	source := createDir(map[string]string{
+		"layout.yaml": `
+prompts:
+  - var: module
+generators:
+  - name: service
+    args: [service]
+    prompts:
+      - var: service
+      - var: module
+`,
+		"content/go.mod":            "module {{.module}}",
+		"content/services/keep.txt": "keep",
+		"generators/service/content/services/{{.service}}/main.go": "package {{.service}} // {{.module}}",
+	})
+	defer os.RemoveAll(source)
+
+	dest, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	err = Deploy(context.Background(), Config{
+		Source:  source,
+		Target:  dest,
+		Display: simple.New(bufio.NewReader(strings.NewReader("example.com/demo\n")), io.Discard),
+		AskOnce: true,
+	})
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(dest, AnswersFile))
+
+	// stored answer used as default for module, service from argument
+	err = Generate(context.Background(), GenerateConfig{
+		Config: Config{
+			Target:  filepath.Join(dest, "services"),
+			Display: simple.New(bufio.NewReader(strings.NewReader("\n")), io.Discard),
+			AskOnce: true,
+		},
+		Generator: "service",
+		Args:      []string{"users"},
+	})
+	require.NoError(t, err)
+
+	requireContent(t, "package users // example.com/demo", filepath.Join(dest, "services", "users", "main.go"))
+	requireContent(t, "keep", filepath.Join(dest, "services", "keep.txt"))
+
+	err = Generate(context.Background(), GenerateConfig{
+		Config: Config{
+			Target:  dest,
+			Display: simple.New(bufio.NewReader(strings.NewReader("")), io.Discard),
+			AskOnce: true,
+		},
+		Generator: "unknown",
+	})
+	require.Error(t, err)
+}
+
+func TestGenerateInherits(t *testing.T) {
+	source := createDir(map[string]string{
+		"layout.yaml": `
+delimiters: {open: "[[", close: "]]"}
+engines:
+  - glob: "*.j2"
+    engine: jinja
+prompts:
+  - var: module
+generators:
+  - name: service
+    args: [service]
+    prompts:
+      - var: service
+`,
+		"partials/header.txt":                           "// module [[.module]]",
+		"partials/header.j2":                            "# module {{ module }}",
+		"content/go.mod":                                "module [[.module]]",
+		"generators/service/content/[[.service]].go":    "[[template \"header\" .]]\npackage [[.service]]",
+		"generators/service/content/[[.service]].md.j2": "{% include \"header.j2\" %}\n{{ service }}",
+		"generators/service/partials/header.txt":        "// service [[.service]] of [[.module]]",
+	})
+	defer os.RemoveAll(source)
+
+	dest := t.TempDir()
+	err := Deploy(context.Background(), Config{
+		Source:  source,
+		Target:  dest,
+		Answers: map[string]interface{}{"module": "example.com/demo"},
+		AskOnce: true,
+	})
+	require.NoError(t, err)
+
+	err = Generate(context.Background(), GenerateConfig{
+		Config:    Config{Target: dest, AskOnce: true},
+		Generator: "service",
+		Args:      []string{"users"},
+	})
+	require.NoError(t, err)
+
+	requireContent(t, "// service users of example.com/demo\npackage users", filepath.Join(dest, "users.go"))
+	requireContent(t, "# module example.com/demo\nusers", filepath.Join(dest, "users.md.j2"))
+
+	answers, err := loadAnswers(filepath.Join(dest, AnswersFile))
+	require.NoError(t, err)
+	require.Equal(t, "example.com/demo", answers.Values["module"])
+	require.Equal(t, "users", answers.Values["service"])
+}
@@ -0,0 +1,369 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/reddec/layout/internal/ui"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	TestsDir     = "tests"     // directory next to manifest with test cases
+	TestCaseFile = "test.yaml" // test case definition inside test case directory
+	ExpectedDir  = "expected"  // golden directory inside test case directory
+)
+
+// TestCase defines how layout should be rendered and what to ignore during comparison with golden directory.
+type TestCase struct {
+	Answers  map[string]interface{} // answers for prompts, not answered prompts will use default values
+	Defaults map[string]interface{} // global default values, same as values in configuration
+	Ignore   []string               // globs (relative to destination) of files which content should not be compared
+}
+
+// TestConfig of layout testing.
+type TestConfig struct {
+	Source  string   // path to directory with layout (or layouts)
+	Update  bool     // regenerate golden directories instead of comparing
+	Version string   // current version, used to filter manifests by constraints
+	Debug   bool     // enable debug messages and tracing
+	Trusted []string // remote base layouts (sources, URLs, or URL prefixes ended by / or :) which hooks are allowed
+	Yes     bool     // allow hooks of all remote base layouts
+}
+
+// TestResult of single test case.
+type TestResult struct {
+	Layout      string   // path to layout directory
+	Name        string   // test case name (directory name)
+	Differences []string // human-readable differences between rendered and expected content
+	Err         error    // error during rendering
+}
+
+// Ok returns true if layout rendered without errors and without differences with golden directory.
+func (tr TestResult) Ok() bool {
+	return tr.Err == nil && len(tr.Differences) == 0
+}
+
+// Test discovers test cases in each layout (tests/<name>/test.yaml) in source directory, renders layout
+// with answers from the test case to temporary directory and compares result with golden directory (tests/<name>/expected).
+// In update mode golden directory will be replaced by rendered content.
+//
+// Temporary destination directory has the same name as test case, so dirname magic variable is stable between runs.
+// Hooks of remote base layouts (see extends) are executed only if they are trusted, otherwise test case fails.
+func Test(ctx context.Context, config TestConfig) ([]TestResult, error) {
+	manifestFiles, err := findManifests(config.Source)
+	if err != nil {
+		return nil, fmt.Errorf("find manifests: %w", err)
+	}
+	if len(manifestFiles) == 0 {
+		return nil, fmt.Errorf("no manifests files discovered")
+	}
+	var results []TestResult
+	for _, manifestFile := range manifestFiles {
+		layoutDir := filepath.Dir(manifestFile)
+		cases, err := findTestCases(layoutDir)
+		if err != nil {
+			return nil, fmt.Errorf("find test cases in %s: %w", layoutDir, err)
+		}
+		for _, name := range cases {
+			if ctx.Err() != nil {
+				return results, ctx.Err()
+			}
+			res := TestResult{Layout: layoutDir, Name: name}
+			res.Differences, res.Err = testCase(ctx, config, manifestFile, name)
+			results = append(results, res)
+		}
+	}
+	return results, nil
+}
+
+// list names of directories in tests directory which contains test case file. Result is sorted.
+func findTestCases(layoutDir string) ([]string, error) {
+	list, err := os.ReadDir(filepath.Join(layoutDir, TestsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, item := range list {
+		if !item.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(layoutDir, TestsDir, item.Name(), TestCaseFile)); err == nil {
+			names = append(names, item.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func testCase(ctx context.Context, config TestConfig, manifestFile string, name string) ([]string, error) {
+	layoutDir := filepath.Dir(manifestFile)
+	caseDir := filepath.Join(layoutDir, TestsDir, name)
+
+	tc, err := loadTestCase(filepath.Join(caseDir, TestCaseFile))
+	if err != nil {
+		return nil, fmt.Errorf("load test case: %w", err)
+	}
+
+	manifest, err := loadManifest(manifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("load manifest %s: %w", manifestFile, err)
+	}
+
+	if ok, err := manifest.isSupportedVersion(config.Version); err != nil {
+		return nil, fmt.Errorf("check manifest version: %w", err)
+	} else if !ok {
+		return nil, fmt.Errorf("manifest version constraint (%s) requires another version of application (current %s)", manifest.Version, config.Version)
+	}
+
+	renderConfig := Config{
+		Display:  &defaultsUI{},
+		Debug:    config.Debug,
+		Version:  config.Version,
+		AskOnce:  true,
+		Defaults: tc.Defaults,
+		Answers:  tc.Answers,
+		Trusted:  config.Trusted,
+		NoInput:  true,
+	}.withDefaults(ctx)
+
+	manifest, layoutDir, cleanup, err := manifest.compose(ctx, renderConfig, layoutDir, 0)
+	if err != nil {
+		return nil, fmt.Errorf("compose layout: %w", err)
+	}
+	defer cleanup()
+
+	if !config.Yes {
+		if err := confirmHooks(ctx, renderConfig, manifest.remotes, manifest.hooks()); err != nil {
+			return nil, err
+		}
+	}
+
+	tmpDir, err := os.MkdirTemp("", "layout-test-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	targetDir := filepath.Join(tmpDir, name)
+	_, err = manifest.renderTo(ctx, renderConfig, targetDir, layoutDir, nil)
+	if err != nil {
+		return nil, fmt.Errorf("render: %w", err)
+	}
+
+	expectedDir := filepath.Join(caseDir, ExpectedDir)
+	if config.Update {
+		if err := os.RemoveAll(expectedDir); err != nil {
+			return nil, fmt.Errorf("remove old golden directory: %w", err)
+		}
+		if err := os.MkdirAll(expectedDir, 0755); err != nil {
+			return nil, fmt.Errorf("create golden directory: %w", err)
+		}
+		if _, err := CopyTree(targetDir, expectedDir); err != nil {
+			return nil, fmt.Errorf("update golden directory: %w", err)
+		}
+		return nil, nil
+	}
+
+	return compareTrees(expectedDir, targetDir, tc.Ignore)
+}
+
+func loadTestCase(file string) (*TestCase, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tc TestCase
+	err = yaml.NewDecoder(f).Decode(&tc)
+	if errors.Is(err, io.EOF) { // empty file is valid test case
+		err = nil
+	}
+	return &tc, err
+}
+
+// compare files in expected and actual directories. Returns human-readable list of differences.
+// Content of files matched by ignore patterns is not compared, but files still should exist in both directories.
+func compareTrees(expectedDir, actualDir string, ignore []string) ([]string, error) {
+	expected, err := listFiles(expectedDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("list expected files: %w", err)
+	}
+	actual, err := listFiles(actualDir)
+	if err != nil {
+		return nil, fmt.Errorf("list actual files: %w", err)
+	}
+
+	ignored := newGlobMatcher(ignore)
+	var diffs []string
+	for _, file := range sortedKeys(expected) {
+		if !actual[file] {
+			diffs = append(diffs, "missing "+file)
+		}
+	}
+	for _, file := range sortedKeys(actual) {
+		if !expected[file] {
+			diffs = append(diffs, "unexpected "+file)
+			continue
+		}
+		if ignored.Match(file, false) {
+			continue
+		}
+		diff, err := diffFiles(filepath.Join(expectedDir, file), filepath.Join(actualDir, file))
+		if err != nil {
+			return nil, fmt.Errorf("compare %s: %w", file, err)
+		}
+		if diff != "" {
+			diffs = append(diffs, "content of "+file+" differs:\n"+diff)
+		}
+	}
+	return diffs, nil
+}
+
+// list all files (not directories) in root directory, paths are relative to root and slash-separated.
+func listFiles(root string) (map[string]bool, error) {
+	var files = make(map[string]bool)
+	err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	return files, err
+}
+
+// unified diff between two files. Returns empty string if content is the same.
+// Symbolic links are compared by targets.
+func diffFiles(expectedFile, actualFile string) (string, error) {
+	expectedLink, err := readLink(expectedFile)
+	if err != nil {
+		return "", err
+	}
+	actualLink, err := readLink(actualFile)
+	if err != nil {
+		return "", err
+	}
+	if expectedLink != actualLink {
+		return fmt.Sprintf("-link %q\n+link %q\n", expectedLink, actualLink), nil
+	}
+	if expectedLink != "" {
+		return "", nil
+	}
+
+	expected, err := os.ReadFile(expectedFile)
+	if err != nil {
+		return "", err
+	}
+	actual, err := os.ReadFile(actualFile)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Equal(expected, actual) {
+		return "", nil
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(expected)),
+		B:        difflib.SplitLines(string(actual)),
+		FromFile: "expected",
+		ToFile:   "actual",
+		Context:  3,
+	})
+}
+
+// returns target of symbolic link or empty string if file is not a link.
+func readLink(file string) (string, error) {
+	info, err := os.Lstat(file)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return "", nil
+	}
+	return os.Readlink(file)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// defaultsUI is non-interactive UI which always picks default values and ignores messages.
+type defaultsUI struct{}
+
+func (d *defaultsUI) One(_ context.Context, _ string, defaultValue string) (string, error) {
+	return defaultValue, nil
+}
+
+func (d *defaultsUI) Many(_ context.Context, _ string, defaultValue []string) ([]string, error) {
+	return defaultValue, nil
+}
+
+func (d *defaultsUI) Select(_ context.Context, question string, defaultValue string, options []string) (string, error) {
+	for _, opt := range options {
+		if opt == defaultValue {
+			return defaultValue, nil
+		}
+	}
+	return "", fmt.Errorf("no answer and no valid default value for %q", strings.TrimSpace(question))
+}
+
+func (d *defaultsUI) Choose(_ context.Context, _ string, defaultValue []string, _ []string) ([]string, error) {
+	return defaultValue, nil
+}
+
+func (d *defaultsUI) Error(context.Context, string) error { return nil }
+
+func (d *defaultsUI) Title(context.Context, string) error { return nil }
+
+func (d *defaultsUI) Info(context.Context, string) error { return nil }
+
+func (d *defaultsUI) Output(context.Context, string) (ui.Log, error) { return discardLog{}, nil }
+
+// discardLog ignores all output.
+type discardLog struct{}
+
+func (discardLog) Write(p []byte) (int, error) { return len(p), nil }
+
+func (discardLog) Done(error) error { return nil }
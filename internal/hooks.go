@@ -17,13 +17,295 @@ limitations under the License.
 package internal
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/reddec/layout/internal/ui"
 )
 
-// display (if set) label of hook
-func (h Hook) display(ctx context.Context, printer func(ctx context.Context, message string) error) error {
-	if h.Label == "" {
+const defaultHooksWorkers = 4 // default maximum number of concurrently executed hooks of parallel group
+
+// hooksRunner executes hooks of manifest stages, shows their output in UI and saves it to log file.
+type hooksRunner struct {
+	display        ui.UI
+	renderer       *renderContext
+	destinationDir string
+	workDir        string // directory where hooks are executed (staging), destination if not set
+	finished       bool   // generation finished (or failed), hooks are not executed outside of destination anymore
+	layoutDir      string
+	logFile        string   // path to log file, temporary file will be created if not set
+	sandbox        *Sandbox // restrictions for hooks, nil means no restrictions
+	workers        int      // maximum number of concurrently executed hooks of parallel group
+	log            *os.File // opened on first executed hook
+}
+
+func newHooksRunner(config Config, renderer *renderContext, destinationDir, layoutDir string) *hooksRunner {
+	workers := config.HooksWorkers
+	if workers <= 0 {
+		workers = defaultHooksWorkers
+	}
+	return &hooksRunner{
+		display:        config.Display,
+		renderer:       renderer,
+		destinationDir: destinationDir,
+		layoutDir:      layoutDir,
+		logFile:        config.HooksLog,
+		sandbox:        config.Sandbox,
+		workers:        workers,
+	}
+}
+
+// run hooks of stage one by one, hooks with false condition are skipped. Consecutive hooks with the same parallel
+// group are executed concurrently.
+// Hooks are executed in work (staging) directory or destination directory. Before generation finished, if destination
+// is not created yet, hooks are executed in the nearest existing parent directory, after that such hooks are skipped.
+func (hr *hooksRunner) run(ctx context.Context, stage string, hooks []Hook) error {
+	workDir, ok := hr.dir()
+	if !ok {
+		if len(hooks) == 0 {
+			return nil
+		}
+		return hr.display.Info(ctx, fmt.Sprintf("Destination %s does not exist, %s hooks skipped", hr.destinationDir, stage))
+	}
+	for i := 0; i < len(hooks); {
+		if group := hooks[i].Parallel; group != "" {
+			end := i + 1
+			for end < len(hooks) && hooks[end].Parallel == group {
+				end++
+			}
+			if end-i > 1 {
+				if err := hr.runParallel(ctx, stage, hooks[i:end], i, workDir); err != nil {
+					return err
+				}
+				i = end
+				continue
+			}
+		}
+		h := hooks[i]
+		if ok, err := h.When.Ok(ctx, hr.renderer.State()); err != nil {
+			return fmt.Errorf("evaluate condition of %s hook #%d (%s): %w", stage, i, h.what(), err)
+		} else if ok {
+			if err := hr.execute(ctx, h, workDir); err != nil {
+				return fmt.Errorf("execute %s hook #%d (%s): %w", stage, i, h.what(), err)
+			}
+		}
+		i++
+	}
+	return nil
+}
+
+// execute single hook with output redirected to UI (labeled by hook label) and to log file.
+func (hr *hooksRunner) execute(ctx context.Context, h Hook, workDir string) error {
+	if err := hr.openLog(); err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	if _, err := fmt.Fprintf(hr.log, "# %s\n", h.what()); err != nil {
+		return fmt.Errorf("write log file: %w", err)
+	}
+	out, err := hr.display.Output(ctx, h.Label)
+	if err != nil {
+		return fmt.Errorf("show output: %w", err)
+	}
+	err = h.execute(hr.hookContext(ctx, io.MultiWriter(out, hr.log)), hr.renderer, workDir, hr.layoutDir)
+	if doneErr := out.Done(err); doneErr != nil && err == nil {
+		return fmt.Errorf("show output: %w", doneErr)
+	}
+	return err
+}
+
+// run hooks of the same parallel group concurrently by bounded pool of workers.
+// Conditions are evaluated before execution, output of each hook is captured and shown once hook finished,
+// variables exported by hooks are saved after all hooks in order of definition.
+// The first failed hook cancels others and its error returned. Offset is index of the first hook in the stage.
+func (hr *hooksRunner) runParallel(ctx context.Context, stage string, hooks []Hook, offset int, workDir string) error {
+	var selected []int
+	for i, h := range hooks {
+		if ok, err := h.When.Ok(ctx, hr.renderer.State()); err != nil {
+			return fmt.Errorf("evaluate condition of %s hook #%d (%s): %w", stage, offset+i, h.what(), err)
+		} else if ok {
+			selected = append(selected, i)
+		}
+	}
+	if err := hr.openLog(); err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		outputs = make([]map[string]interface{}, len(hooks))
+		queue   = make(chan int)
+		lock    sync.Mutex
+		failed  error // the first (by time) failure
+		wg      sync.WaitGroup
+	)
+	for w := 0; w < hr.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range queue {
+				if ctx.Err() != nil {
+					continue
+				}
+				h := hooks[idx]
+				var buffer syncBuffer
+				output, err := h.run(hr.hookContext(ctx, &buffer), hr.renderer, workDir, hr.layoutDir)
+
+				lock.Lock()
+				if showErr := hr.show(ctx, h, buffer.Bytes(), err); showErr != nil && err == nil {
+					err = fmt.Errorf("show output: %w", showErr)
+				}
+				if err != nil && failed == nil {
+					failed = fmt.Errorf("execute %s hook #%d (%s): %w", stage, offset+idx, h.what(), err)
+					cancel()
+				}
+				outputs[idx] = output
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, idx := range selected {
+		queue <- idx
+	}
+	close(queue)
+	wg.Wait()
+
+	if failed != nil {
+		return failed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, output := range outputs {
+		for k, v := range output {
+			hr.renderer.Save(k, v)
+		}
+	}
+	return nil
+}
+
+// show captured output of finished hook in UI and save it to log file.
+func (hr *hooksRunner) show(ctx context.Context, h Hook, output []byte, result error) error {
+	if _, err := fmt.Fprintf(hr.log, "# %s\n%s", h.what(), output); err != nil {
+		return fmt.Errorf("write log file: %w", err)
+	}
+	out, err := hr.display.Output(ctx, h.Label)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(output); err != nil {
+		return err
+	}
+	return out.Done(result)
+}
+
+// context for hook: output redirected to writer, destination for LAYOUT_DEST, and sandbox (if set) allows writes
+// to destination and work directory.
+func (hr *hooksRunner) hookContext(ctx context.Context, output io.Writer) context.Context {
+	ctx = withDestination(withOutput(ctx, output), hr.destinationDir)
+	if hr.sandbox != nil {
+		writable := []string{hr.destinationDir}
+		if hr.workDir != "" {
+			writable = append(writable, hr.workDir)
+		}
+		ctx = withSandbox(ctx, hr.sandbox.writableAt(writable...))
+	}
+	return ctx
+}
+
+func (hr *hooksRunner) openLog() error {
+	if hr.log != nil {
 		return nil
 	}
-	return printer(ctx, h.Label)
+	var err error
+	if hr.logFile == "" {
+		hr.log, err = os.CreateTemp("", "layout-hooks-*.log")
+	} else {
+		hr.log, err = os.OpenFile(hr.logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	}
+	return err
+}
+
+// close log file and return result of generation. Temporary log file is removed if generation succeeded,
+// otherwise path to log file is added to the error. Failed close of kept log file is reported, since the log could
+// be incomplete.
+func (hr *hooksRunner) close(result error) error {
+	if hr.log == nil {
+		return result
+	}
+	closeErr := hr.log.Close()
+	if result == nil && hr.logFile == "" {
+		return os.Remove(hr.log.Name())
+	}
+	if closeErr != nil {
+		closeErr = fmt.Errorf("close hooks log file %s: %w", hr.log.Name(), closeErr)
+		if result == nil {
+			return closeErr
+		}
+		result = fmt.Errorf("%w (also %v)", result, closeErr)
+	}
+	if result != nil {
+		return fmt.Errorf("%w (hooks output saved to %s)", result, hr.log.Name())
+	}
+	return nil
+}
+
+// all hooks of manifest in order of stages.
+func (m *Manifest) hooks() []Hook {
+	var all []Hook
+	for _, stage := range [][]Hook{m.Init, m.PostPrompt, m.Before, m.After, m.OnError, m.Finally} {
+		all = append(all, stage...)
+	}
+	return all
+}
+
+// returns dir if it exists, otherwise the nearest existing parent.
+func existingDir(dir string) string {
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// directory where hooks are executed. Returns false if there is no such directory.
+func (hr *hooksRunner) dir() (string, bool) {
+	for _, dir := range []string{hr.workDir, hr.destinationDir} {
+		if info, err := os.Stat(dir); dir != "" && err == nil && info.IsDir() {
+			return dir, true
+		}
+	}
+	if hr.finished {
+		return "", false
+	}
+	return existingDir(hr.destinationDir), true
+}
+
+// buffer safe for concurrent writes.
+type syncBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	return sb.buffer.Write(p)
+}
+
+func (sb *syncBuffer) Bytes() []byte {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	return sb.buffer.Bytes()
 }
@@ -17,26 +17,25 @@ limitations under the License.
 package internal
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
-	"text/template"
-
-	"github.com/Masterminds/sprig/v3"
-	"github.com/reddec/layout/internal/ui"
 
 	"github.com/Masterminds/semver"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/go-git/go-git/v5"
 	"gopkg.in/yaml.v3"
 )
 
 const (
-	MagicVarDir = "dirname" // contains base name of destination directory (aka: project name)
+	MagicVarDir   = "dirname"  // contains base name of destination directory (aka: project name)
+	MagicVarError = "error"    // contains error message for on-error hooks
+	PartialsDir   = "partials" // directory in layout with shared templates
 )
 
 // Loads YAML manifest from file, does not support multi-document format.
@@ -51,140 +50,261 @@ func loadManifest(file string) (*Manifest, error) {
 	return &m, yaml.NewDecoder(f).Decode(&m)
 }
 
-// Communicates with user and renders all templates and executes hooks. Debug flag enables state dump to stdout
-// after user input. Once flags disables retry on wrong user input.
-func (m *Manifest) renderTo(ctx context.Context, display ui.UI, destinationDir, layoutDir string, debug, once bool, initialState map[string]interface{}) error {
+// Communicates with user and renders all templates and executes hooks. Config should be already with defaults.
+// Debug flag enables state dump to stdout after user input. AskOnce flag disables retry on wrong user input.
+// If answers set, they are saved (with values from state) to the generated project before post-generate hooks.
+// Returns final state.
+func (m *Manifest) renderTo(ctx context.Context, config Config, destinationDir, layoutDir string, answers *Answers) (map[string]interface{}, error) {
+	ctx = withWorkDir(ctx, destinationDir) // for helpers in conditions
+	display := config.Display
 	welcomeMessage := strings.TrimSpace(strings.Join([]string{m.Title, m.Description}, "\n\n"))
 	if welcomeMessage != "" {
 		if err := display.Title(ctx, welcomeMessage); err != nil {
-			return fmt.Errorf("show welcome message: %w", err)
+			return nil, fmt.Errorf("show welcome message: %w", err)
 		}
 	}
 	var state = make(map[string]interface{})
-	for k, v := range initialState {
+	for k, v := range config.Defaults {
 		state[k] = v
 	}
 	// set required magic variables
 	state[MagicVarDir] = filepath.Base(destinationDir)
 	renderer := newRenderContext(state).Delimiters(m.Delimiters.Open, m.Delimiters.Close).WorkDir(destinationDir)
+	if err := renderer.Partials(append(append([]string{}, m.partials...), filepath.Join(layoutDir, PartialsDir))...); err != nil {
+		return nil, fmt.Errorf("load partials: %w", err)
+	}
+
+	hooks := newHooksRunner(config, renderer, destinationDir, layoutDir)
+	tx := newTransaction(destinationDir)
+	err := m.generate(ctx, config, renderer, hooks, tx, layoutDir, answers)
+	hooks.finished = true
+	if err != nil {
+		// on-error hooks see failed state: staging directory if failed before commit, otherwise destination
+		errCtx := ctx
+		if hooks.workDir != "" {
+			errCtx = withWorkDir(ctx, hooks.workDir)
+		}
+		renderer.Save(MagicVarError, err.Error())
+		if hookErr := hooks.run(errCtx, "on-error", m.OnError); hookErr != nil {
+			err = fmt.Errorf("%w (also %v)", err, hookErr)
+		}
+	}
+	if err == nil {
+		err = tx.cleanup()
+	} else if config.DisableCleanup {
+		if kept := tx.kept(); kept != "" {
+			err = fmt.Errorf("%w (%s)", err, kept)
+		}
+	} else if rbErr := tx.rollback(); rbErr != nil {
+		err = fmt.Errorf("%w (also rollback: %v)", err, rbErr)
+	}
+	hooks.workDir = ""
+	renderer.WorkDir(destinationDir)
+	if hookErr := hooks.run(ctx, "finally", m.Finally); hookErr != nil {
+		if err == nil {
+			err = hookErr
+		} else {
+			err = fmt.Errorf("%w (also %v)", err, hookErr)
+		}
+	}
+	if err := hooks.close(err); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
 
+// generate project: ask user, compute state, copy and render content, and execute hooks (except on-error and finally).
+// Content is copied and rendered (including pre-generate hooks) in staging directory of transaction, which is committed
+// to destination before post-generate hooks. Until commit, hooks, template helpers, and conditions use staging
+// directory as work dir.
+func (m *Manifest) generate(ctx context.Context, config Config, renderer *renderContext, hooks *hooksRunner, tx *transaction, layoutDir string, answers *Answers) error {
+	destinationDir := tx.destination
+	display := config.Display
+	gitInit, err := m.gitInit(ctx, config, destinationDir)
+	if err != nil {
+		return err
+	}
 	for i, c := range m.Default {
-		if err := c.compute(renderer); err != nil {
+		if err := c.compute(ctx, renderer); err != nil {
 			return fmt.Errorf("set default value #%d (%s): %w", i, c.Var, err)
 		}
 	}
 
-	if err := askState(ctx, display, m.Prompts, "", layoutDir, renderer, once); err != nil {
+	if err := hooks.run(ctx, "init", m.Init); err != nil {
+		return err
+	}
+
+	if err := askState(ctx, display, m.Prompts, "", layoutDir, renderer, config.AskOnce, config.Answers); err != nil {
 		return fmt.Errorf("get values for prompts: %w", err)
 	}
 
-	for i, c := range m.Computed {
-		if err := c.compute(ctx, renderer); err != nil {
-			return fmt.Errorf("compute value #%d (%s): %w", i, c.Var, err)
+	if err := m.compute(ctx, renderer); err != nil {
+		return err
+	}
+
+	// in interactive mode user can re-answer prompts involved in failed assertions
+	for {
+		err := checkAssertions(ctx, renderer, m.Assert)
+		var assertErr *AssertionError
+		if err == nil {
+			break
+		}
+		if !errors.As(err, &assertErr) || config.AskOnce {
+			return err
+		}
+		if err := display.Error(ctx, assertErr.Error()); err != nil {
+			return fmt.Errorf("show failed assertions: %w", err)
+		}
+		retry, err := display.Select(ctx, "Re-answer questions?", "yes", []string{"yes", "no"})
+		if err != nil {
+			return fmt.Errorf("ask for retry: %w", err)
+		}
+		if retry != "yes" {
+			return assertErr
+		}
+		if err := askState(ctx, display, m.Prompts, "", layoutDir, renderer, config.AskOnce, assertErr.keepAnswers(renderer.State(), m.Computed)); err != nil {
+			return fmt.Errorf("get values for prompts: %w", err)
 		}
+		if err := m.compute(ctx, renderer); err != nil {
+			return err
+		}
+	}
+
+	if config.Debug {
+		spew.Dump(renderer.State())
 	}
 
-	if debug {
-		spew.Dump(state)
+	if err := hooks.run(ctx, "post-prompt", m.PostPrompt); err != nil {
+		return err
 	}
 
 	// here there is sense to copy content, not before state computation
-	if err := os.MkdirAll(destinationDir, 0755); err != nil {
-		return fmt.Errorf("create destination: %w", err)
+	stagingDir, err := tx.begin()
+	if err != nil {
+		return err
+	}
+	destinationCtx := ctx
+	ctx = withWorkDir(ctx, stagingDir)
+	renderer.WorkDir(stagingDir)
+	hooks.workDir = stagingDir
+
+	ignoredFiles, copyOnlyFiles, err := loadIgnoreFile(filepath.Join(layoutDir, LayoutIgnoreFile))
+	if err != nil {
+		return fmt.Errorf("load %s: %w", LayoutIgnoreFile, err)
 	}
 
-	tree, err := CopyTree(filepath.Join(layoutDir, ContentDir), destinationDir)
+	tree, err := CopyTree(filepath.Join(layoutDir, ContentDir), stagingDir, ignoreMapper(ignoredFiles), filesMapper(ctx, m.Files, renderer))
 	if err != nil {
 		return fmt.Errorf("copy content: %w", err)
 	}
 
-	if debug {
+	if config.Debug {
 		spew.Dump(tree)
 	}
 
 	// execute pre-generate
-	for i, h := range m.Before {
-		if ok, err := h.When.Ok(ctx, state); err != nil {
-			return fmt.Errorf("evaluate condition of pre-generate hook #%d (%s): %w", i, h.what(), err)
-		} else if !ok {
-			continue
-		}
-		if err := h.display(ctx, display.Info); err != nil {
-			return fmt.Errorf("display pre-generate hook #%d (%s): %w", i, h.what(), err)
-		}
-		if err := h.execute(ctx, renderer, destinationDir, layoutDir); err != nil {
-			return fmt.Errorf("execute pre-generate hook #%d (%s): %w", i, h.what(), err)
-		}
+	if err := hooks.run(ctx, "pre-generate", m.Before); err != nil {
+		return err
 	}
 
 	// render template based on tree
 	// rename files and dirs, empty entries removed
+	noRename := newGlobMatcher(m.NoRename)
 	err = tree.Render(func(node *FSTree) (string, error) {
+		if noRename.Match(node.Source, node.Dir) {
+			return node.Name, nil
+		}
 		return renderer.Render(node.Name)
 	})
 	if err != nil {
 		return fmt.Errorf("render files names: %w", err)
 	}
 
-	// render file contents as template, except ignored
-	ignoredFiles, err := m.filesToIgnore(destinationDir)
+	// render file contents as template, except ignored (by rendered path) and copy-only (by source path)
+	ignore := newGlobMatcher(m.Ignore)
+	copyOnly := newGlobMatcher(append(copyOnlyFiles, m.CopyOnly...))
+	selectEngine, err := renderer.engineSelector(m.Engines)
 	if err != nil {
-		return fmt.Errorf("calculate which files to ignore: %w", err)
+		return fmt.Errorf("select engines: %w", err)
 	}
+	var files []renderJob
 	err = tree.Render(func(node *FSTree) (string, error) {
 		if node.Dir {
 			return node.Name, nil
 		}
 		path := node.Path()
-		if ignoredFiles[path] {
-			return node.Name, nil
-		}
-		templateData, err := ioutil.ReadFile(path)
+		relPath, err := filepath.Rel(stagingDir, path)
 		if err != nil {
-			return node.Name, fmt.Errorf("read content of %s: %w", path, err)
+			return node.Name, fmt.Errorf("calculate relative path of %s: %w", path, err)
 		}
-		data, err := renderer.Render(string(templateData))
-		if err != nil {
-			return node.Name, fmt.Errorf("render %s: %w", path, err)
+		if ignore.Match(filepath.ToSlash(relPath), false) || copyOnly.Match(node.Source, false) {
+			return node.Name, nil
+		}
+		if engine := selectEngine(node.Source); engine != nil {
+			files = append(files, renderJob{file: path, engine: engine})
 		}
-		return node.Name, ioutil.WriteFile(path, []byte(data), 0755)
+		return node.Name, nil
 	})
 	if err != nil {
+		return fmt.Errorf("collect files: %w", err)
+	}
+	if err := renderer.RenderFiles(ctx, files, 0); err != nil {
 		return fmt.Errorf("render: %w", err)
 	}
 
-	// exec post-generate
-	for i, h := range m.After {
-		if ok, err := h.When.Ok(ctx, state); err != nil {
-			return fmt.Errorf("evaluate condition of post-generate hook #%d (%s): %w", i, h.what(), err)
-		} else if !ok {
-			continue
-		}
-		if err := h.display(ctx, display.Info); err != nil {
-			return fmt.Errorf("display post-generate hook #%d (%s): %w", i, h.what(), err)
-		}
-		if err := h.execute(ctx, renderer, destinationDir, layoutDir); err != nil {
-			return fmt.Errorf("execute post-generate hook #%d (%s): %w", i, h.what(), err)
+	if err := m.Chmod.apply(tree, stagingDir); err != nil {
+		return fmt.Errorf("change modes: %w", err)
+	}
+
+	if answers != nil {
+		if err := answers.withValues(renderer.State()).save(filepath.Join(stagingDir, AnswersFile)); err != nil {
+			return fmt.Errorf("save answers: %w", err)
 		}
 	}
 
+	if err := tx.commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	ctx = destinationCtx
+	renderer.WorkDir(destinationDir)
+	hooks.workDir = ""
+
+	// exec post-generate
+	if err := hooks.run(ctx, "post-generate", m.After); err != nil {
+		return err
+	}
+
+	if gitInit == nil {
+		return nil
+	}
+	action, err := gitInit.render(renderer)
+	if err != nil {
+		return fmt.Errorf("render git init: %w", err)
+	}
+	if err := action.apply(destinationDir); err != nil {
+		return fmt.Errorf("initialize git repository: %w", err)
+	}
 	return nil
 }
 
-// generates list of files which should be not rendered as template.
-// Executes AFTER rendering file names.
-func (m *Manifest) filesToIgnore(contentDir string) (map[string]bool, error) {
-	var set = make(map[string]bool)
-	for i, pattern := range m.Ignore {
-		list, err := filepath.Glob(filepath.Join(contentDir, pattern))
-		if err != nil {
-			return nil, fmt.Errorf("match files in ignore pattern #%d (%s): %w", i, pattern, err)
+// git init settings if repository initialization requested by manifest or by config. Manifest settings are used even
+// if it is requested only by config. Initialization is skipped (with notice) if destination is already a repository.
+func (m *Manifest) gitInit(ctx context.Context, config Config, destinationDir string) (*GitInitAction, error) {
+	gitInit := m.GitInit
+	if !gitInit.enabled() {
+		if !config.GitInit {
+			return nil, nil
 		}
-		for _, file := range list {
-			set[file] = true
+		gitInit = &GitInitAction{}
+	}
+	if _, err := git.PlainOpen(destinationDir); err == nil {
+		if err := config.Display.Info(ctx, "Git repository already exists in "+destinationDir+", initialization skipped"); err != nil {
+			return nil, fmt.Errorf("show notice: %w", err)
 		}
+		return nil, nil
 	}
-	return set, nil
+	return gitInit, nil
 }
 
 // walk is customized implementation of filepath.WalkDir which supports FS modifications in handler.
@@ -232,73 +352,14 @@ func (m *Manifest) isSupportedVersion(currentVersion string) (bool, error) {
 	return constraint.Check(version), nil
 }
 
-func newRenderContext(initialState map[string]interface{}) *renderContext {
-	return &renderContext{
-		state: initialState,
-		open:  "{{",
-		close: "}}",
-	}
-}
-
-// renderContext aggregates required information for rendering templates.
-type renderContext struct {
-	state   map[string]interface{}
-	open    string
-	close   string
-	workDir string // real destination directory
-}
-
-// Delimiters which will be used in template. Default is {{ and }}.
-func (r *renderContext) Delimiters(open, close string) *renderContext {
-	if open != "" {
-		r.open = open
-	}
-	if close != "" {
-		r.close = close
-	}
-	return r
-}
-
-// WorkDir sets location which will be used as root for rendering functions.
-func (r *renderContext) WorkDir(path string) *renderContext {
-	r.workDir = path
-	return r
-}
-
-// State of context with all known variables.
-func (r *renderContext) State() map[string]interface{} {
-	return r.state
-}
-
-// Save value in the state
-func (r *renderContext) Save(key string, value interface{}) {
-	if r.state == nil {
-		r.state = make(map[string]interface{})
-	}
-	r.state[key] = value
-}
-
-// Render go-template value with state as context in memory.
-func (r *renderContext) Render(value string) (string, error) {
-	if r.workDir == "" {
-		p, err := os.Getwd()
-		if err != nil {
-			return "", err
+// calculate computed values.
+func (m *Manifest) compute(ctx context.Context, renderer *renderContext) error {
+	for i, c := range m.Computed {
+		if err := c.compute(ctx, renderer); err != nil {
+			return fmt.Errorf("compute value #%d (%s): %w", i, c.Var, err)
 		}
-		r.workDir = p
-	}
-	funcMap := sprig.TxtFuncMap()
-	funcMap["getRootFile"] = getRootFile(r.workDir)
-	funcMap["findRootFile"] = findRootFile(r.workDir)
-	funcMap["findRootDir"] = findRootDir(r.workDir)
-	funcMap["findSubmatch"] = findSubmatchAll
-	p, err := template.New("").Delims(r.open, r.close).Funcs(funcMap).Parse(value)
-	if err != nil {
-		return "", err
 	}
-	var out bytes.Buffer
-	err = p.Execute(&out, r.state)
-	return out.String(), err
+	return nil
 }
 
 // get content of file with specific name (can be only base name) in any of root folders:
@@ -44,6 +44,31 @@ func TestCustomDelimiters(t *testing.T) {
 	})
 }
 
+func TestPartials(t *testing.T) {
+	dir := createDir(map[string]string{
+		"header.tmpl":    "// Copyright {{.owner}}",
+		"go/package.txt": `{{define "pkg"}}package {{.}}{{end}}`,
+	})
+	defer os.RemoveAll(dir)
+
+	r := newRenderContext(map[string]interface{}{"owner": "alice"})
+	require.NoError(t, r.Partials(dir))
+
+	t.Run("by name without extension", func(t *testing.T) {
+		v, err := r.Render(`{{template "header" .}}`)
+		require.NoError(t, err)
+		assert.Equal(t, "// Copyright alice", v)
+	})
+	t.Run("by full name and defined blocks", func(t *testing.T) {
+		v, err := r.Render(`{{template "header.tmpl" .}}` + "\n" + `{{template "pkg" "main"}}`)
+		require.NoError(t, err)
+		assert.Equal(t, "// Copyright alice\npackage main", v)
+	})
+	t.Run("missing directory is fine", func(t *testing.T) {
+		require.NoError(t, newRenderContext(nil).Partials(filepath.Join(dir, "missing")))
+	})
+}
+
 func TestGetRootFile(t *testing.T) {
 	workDir, err := filepath.Abs(".")
 	assert.NoError(t, err)
@@ -80,7 +105,7 @@ bar=123,456
 	})
 }
 
-func ExampleFindSubmatch() {
+func Example_findSubmatchAll() {
 	pattern := `foo[ ]+([^ ]+)`
 	text := `foo bar foo baz`
 	out, _ := findSubmatchAll(pattern, text)
@@ -0,0 +1,300 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+const maxCachedTemplate = 4096 // maximum size of template text which will be cached after parsing
+
+func newRenderContext(initialState map[string]interface{}) *renderContext {
+	return &renderContext{
+		state: initialState,
+		open:  "{{",
+		close: "}}",
+	}
+}
+
+// renderContext aggregates required information for rendering templates.
+// Parsed templates (except big ones, such as files content) are cached, so the same value parsed only once.
+// Render is safe for concurrent usage as long as state is not modified.
+type renderContext struct {
+	state       map[string]interface{}
+	open        string
+	close       string
+	workDir     string             // real destination directory
+	partials    *template.Template // parsed shared templates, could be nil
+	partialsDirs []string          // existing directories with shared templates, used by non-go engines
+
+	lock      sync.Mutex
+	base      *template.Template                 // template with functions and partials, used as prototype
+	templates map[templateKey]*template.Template // cached parsed templates
+	engines   map[string]Engine                  // non-go engines by name
+}
+
+type templateKey struct {
+	open  string
+	close string
+	text  string
+}
+
+// Delimiters which will be used in template. Default is {{ and }}.
+func (r *renderContext) Delimiters(open, close string) *renderContext {
+	if open != "" {
+		r.open = open
+	}
+	if close != "" {
+		r.close = close
+	}
+	r.reset()
+	return r
+}
+
+// WorkDir sets location which will be used as root for rendering functions.
+// Already loaded partials are re-bound to the new location.
+func (r *renderContext) WorkDir(path string) *renderContext {
+	r.workDir = path
+	r.reset()
+	if r.partials != nil {
+		r.partials.Funcs(r.funcMap())
+	}
+	return r
+}
+
+// State of context with all known variables.
+func (r *renderContext) State() map[string]interface{} {
+	return r.state
+}
+
+// Save value in the state
+func (r *renderContext) Save(key string, value interface{}) {
+	if r.state == nil {
+		r.state = make(map[string]interface{})
+	}
+	r.state[key] = value
+}
+
+// Partials parses all files in directories (recursive) as named templates which are available in all rendered values
+// by {{template "name" .}}. Name of template is relative (slash-separated) path of file with and without extension.
+// Jinja files (.j2, .jinja, .jinja2) are skipped and available only for jinja engine.
+// Templates from later directories override templates with the same name from earlier directories.
+// Delimiters and work dir should be set before. Directories are optional.
+func (r *renderContext) Partials(dirs ...string) error {
+	r.partialsDirs = nil
+	base := template.New("").Delims(r.open, r.close).Funcs(r.funcMap())
+	var found bool
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		r.partialsDirs = append(r.partialsDirs, dir)
+		if err := parsePartials(base, dir); err != nil {
+			return err
+		}
+		found = true
+	}
+	if found {
+		r.partials = base
+		r.reset()
+	}
+	return nil
+}
+
+// parse files in directory as named templates.
+func parsePartials(base *template.Template, dir string) error {
+	return filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || isJinjaFile(path) {
+			return nil
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", relPath, err)
+		}
+		name := filepath.ToSlash(relPath)
+		names := []string{name}
+		if ext := filepath.Ext(name); ext != "" {
+			names = append(names, strings.TrimSuffix(name, ext))
+		}
+		for _, n := range names {
+			if _, err := base.New(n).Parse(string(content)); err != nil {
+				return fmt.Errorf("parse %s: %w", relPath, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Render go-template value with state as context in memory.
+func (r *renderContext) Render(value string) (string, error) {
+	return r.execute(r.open, r.close, value, r.state)
+}
+
+// renderJob is content file and engine which should be used to render it.
+type renderJob struct {
+	file   string
+	engine Engine
+}
+
+// RenderFiles renders content of files in place by bounded pool of workers (0 means number of CPU).
+// Rendering stops on first error, however, all files before failed one (in order of list) will be processed,
+// so returned error is always for the first failed file in the list regardless of scheduling.
+// Each file is rendered with its own shallow copy of state, so changes made by template (ex: sprig set and unset)
+// are visible only inside the same file.
+func (r *renderContext) RenderFiles(ctx context.Context, files []renderJob, workers int) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	var (
+		errs   = make([]error, len(files))
+		queue  = make(chan int)
+		lock   sync.Mutex
+		failed = len(files) // index of the first failed file
+		wg     sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range queue {
+				lock.Lock()
+				skip := idx > failed
+				lock.Unlock()
+				if skip {
+					continue
+				}
+				err := ctx.Err()
+				if err == nil {
+					err = renderFile(files[idx].engine, mergeValues(r.state, nil), files[idx].file)
+				}
+				if err != nil {
+					errs[idx] = fmt.Errorf("render %s: %w", files[idx].file, err)
+					lock.Lock()
+					if idx < failed {
+						failed = idx
+					}
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := range files {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execute go template with specific delimiters.
+func (r *renderContext) execute(open, close string, value string, state map[string]interface{}) (string, error) {
+	p, err := r.parse(templateKey{open: open, close: close, text: value})
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	err = p.Execute(&out, state)
+	return out.String(), err
+}
+
+// parse template or get it from cache.
+func (r *renderContext) parse(key templateKey) (*template.Template, error) {
+	r.lock.Lock()
+	if r.base == nil {
+		if r.partials != nil {
+			r.base = r.partials
+		} else {
+			r.base = template.New("").Funcs(r.funcMap())
+		}
+	}
+	base := r.base
+	cached, ok := r.templates[key]
+	r.lock.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	cp, err := base.Clone()
+	if err != nil {
+		return nil, err
+	}
+	p, err := cp.New("").Delims(key.open, key.close).Parse(key.text)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key.text) <= maxCachedTemplate {
+		r.lock.Lock()
+		if r.templates == nil {
+			r.templates = make(map[templateKey]*template.Template)
+		}
+		r.templates[key] = p
+		r.lock.Unlock()
+	}
+	return p, nil
+}
+
+// drop cached templates.
+func (r *renderContext) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.base = nil
+	r.templates = nil
+}
+
+func (r *renderContext) funcMap() template.FuncMap {
+	if r.workDir == "" {
+		if p, err := os.Getwd(); err == nil {
+			r.workDir = p
+		}
+	}
+	funcMap := sprig.TxtFuncMap()
+	funcMap["getRootFile"] = getRootFile(r.workDir)
+	funcMap["findRootFile"] = findRootFile(r.workDir)
+	funcMap["findRootDir"] = findRootDir(r.workDir)
+	funcMap["findSubmatch"] = findSubmatchAll
+	for name, fn := range (helpers{workDir: r.workDir}).templateFuncs() {
+		funcMap[name] = fn
+	}
+	return funcMap
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderCache(t *testing.T) {
+	r := newRenderContext(map[string]interface{}{"foo": "bar"})
+	v, err := r.Render("{{.foo}}")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", v)
+	assert.Len(t, r.templates, 1)
+
+	r.Save("foo", "baz")
+	v, err = r.Render("{{.foo}}")
+	require.NoError(t, err)
+	assert.Equal(t, "baz", v, "cached template should use actual state")
+
+	r.Delimiters("[[", "]]")
+	assert.Empty(t, r.templates, "delimiters should drop cache")
+	v, err = r.Render("{{.foo}} [[.foo]]")
+	require.NoError(t, err)
+	assert.Equal(t, "{{.foo}} baz", v)
+}
+
+func TestRenderFiles(t *testing.T) {
+	content := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		content[fmt.Sprintf("file-%03d.txt", i)] = fmt.Sprintf("{{.name}} %d", i)
+	}
+
+	t.Run("all files rendered", func(t *testing.T) {
+		dir := createDir(content)
+		defer os.RemoveAll(dir)
+
+		r := newRenderContext(map[string]interface{}{"name": "alice"})
+		files := renderJobs(t, r, dir, 100)
+		require.NoError(t, r.RenderFiles(context.Background(), files, 4))
+
+		for i, job := range files {
+			data, err := os.ReadFile(job.file)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("alice %d", i), string(data))
+		}
+	})
+
+	t.Run("first failed file reported", func(t *testing.T) {
+		broken := make(map[string]string, len(content))
+		for k, v := range content {
+			broken[k] = v
+		}
+		broken["file-040.txt"] = "{{.name"
+		broken["file-090.txt"] = "{{.name"
+		dir := createDir(broken)
+		defer os.RemoveAll(dir)
+
+		var files []renderJob
+		for attempt := 0; attempt < 10; attempt++ {
+			r := newRenderContext(map[string]interface{}{"name": "alice"})
+			files = renderJobs(t, r, dir, 100)
+			err := r.RenderFiles(context.Background(), files, 8)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "file-040.txt")
+		}
+		// all files before failed one should be rendered
+		for i := 0; i < 40; i++ {
+			data, err := os.ReadFile(files[i].file)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("alice %d", i), string(data))
+		}
+	})
+
+	t.Run("templates modify own copy of state", func(t *testing.T) {
+		modifying := make(map[string]string, len(content))
+		for i := 0; i < 100; i++ {
+			modifying[fmt.Sprintf("file-%03d.txt", i)] = fmt.Sprintf(`{{ $_ := set . "name" "bob" }}{{ $_ := unset . "temp" }}{{.name}} %d`, i)
+		}
+		dir := createDir(modifying)
+		defer os.RemoveAll(dir)
+
+		r := newRenderContext(map[string]interface{}{"name": "alice", "temp": true})
+		files := renderJobs(t, r, dir, 100)
+		require.NoError(t, r.RenderFiles(context.Background(), files, 8))
+
+		for i, job := range files {
+			data, err := os.ReadFile(job.file)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("bob %d", i), string(data))
+		}
+		assert.Equal(t, map[string]interface{}{"name": "alice", "temp": true}, r.State())
+	})
+}
+
+func renderJobs(t *testing.T, r *renderContext, dir string, n int) []renderJob {
+	engine, err := r.Engine(EngineGo, Delimiters{})
+	require.NoError(t, err)
+	var files []renderJob
+	for i := 0; i < n; i++ {
+		files = append(files, renderJob{file: filepath.Join(dir, fmt.Sprintf("file-%03d.txt", i)), engine: engine})
+	}
+	return files
+}
@@ -18,37 +18,190 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
+	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/interp"
 	"mvdan.cc/sh/v3/syntax"
 )
 
-// execute hook as script (priority) or inline shell. Shell is platform-independent, thanks to mvdan.cc/sh.
+const (
+	EnvVarPrefix = "LAYOUT_VAR_"       // prefix of environment variables with state values
+	EnvDest      = "LAYOUT_DEST"       // environment variable with destination directory
+	EnvSource    = "LAYOUT_SOURCE"     // environment variable with layout directory
+	EnvStateFile = "LAYOUT_STATE_FILE" // environment variable with path to JSON file with state
+	EnvOutput    = "LAYOUT_OUTPUT"     // environment variable with path to file where hook can export variables
+)
+
+// execute hook as process (exec), script, or inline shell. Shell is platform-independent, thanks to mvdan.cc/sh.
+// Failed hook is retried as many times as defined by Retries, and failure is ignored if IgnoreError set.
 func (h Runnable) execute(ctx context.Context, renderContext *renderContext, workDir string, layoutFS string) error {
+	output, err := h.run(ctx, renderContext, workDir, layoutFS)
+	if err != nil {
+		return err
+	}
+	for k, v := range output {
+		renderContext.Save(k, v)
+	}
+	return nil
+}
+
+// run hook and return exported variables without modifying state, so it is safe for concurrent usage.
+func (h Runnable) run(ctx context.Context, renderContext *renderContext, workDir string, layoutFS string) (map[string]interface{}, error) {
 	cp, err := h.render(renderContext)
 	if err != nil {
-		return fmt.Errorf("render hook: %w", err)
+		return nil, fmt.Errorf("render hook: %w", err)
+	}
+	destination := destinationFrom(ctx, workDir)
+	if cp.Dir != "" {
+		workDir = filepath.Join(workDir, filepath.FromSlash(cp.Dir))
+	}
+
+	stateFile, err := saveState(renderContext.State())
+	if err != nil {
+		return nil, fmt.Errorf("save state: %w", err)
+	}
+	defer os.RemoveAll(stateFile)
+
+	outputFile, err := createTemp("layout-output-*")
+	if err != nil {
+		return nil, fmt.Errorf("create output file: %w", err)
+	}
+	defer os.RemoveAll(outputFile)
+
+	if sb := sandboxFrom(ctx); sb != nil {
+		ctx = withSandbox(ctx, sb.writableAt(outputFile))
+	}
+
+	env, err := cp.environ(renderContext.State(), destination, layoutFS, stateFile)
+	if err != nil {
+		return nil, fmt.Errorf("prepare environment: %w", err)
+	}
+	env = append(env, EnvOutput+"="+outputFile)
+
+	for attempt := 0; attempt <= cp.Retries; attempt++ {
+		if err = os.Truncate(outputFile, 0); err != nil {
+			return nil, fmt.Errorf("reset output file: %w", err)
+		}
+		err = cp.attempt(ctx, renderContext, workDir, layoutFS, env)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil && cp.IgnoreError && ctx.Err() == nil {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := readOutput(outputFile)
+	if err != nil {
+		return nil, fmt.Errorf("read exported variables: %w", err)
+	}
+	return output, nil
+}
+
+// single attempt to execute hook, limited by timeout (if set).
+func (h Runnable) attempt(ctx context.Context, renderContext *renderContext, workDir string, layoutFS string, env []string) error {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+	var err error
+	switch {
+	case len(h.defined()) > 0:
+		err = h.apply(ctx, workDir, layoutFS)
+	case len(h.Exec) > 0:
+		err = h.executeProcess(ctx, workDir, env)
+	case h.Script != "":
+		err = h.executeScript(ctx, renderContext, workDir, layoutFS, env)
+	default:
+		err = h.executeInline(ctx, workDir, env)
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timeout %v exceeded: %w", h.Timeout, err)
+	}
+	return err
+}
+
+// execute command directly as process, without shell.
+func (h Runnable) executeProcess(ctx context.Context, workDir string, env []string) error {
+	command := h.Exec[0]
+	if sb := sandboxFrom(ctx); sb != nil {
+		file, err := sb.resolveExec(command, workDir, expand.ListEnviron(env...))
+		if err != nil {
+			return err
+		}
+		command = file
+	}
+	cmd := exec.CommandContext(ctx, command, h.Exec[1:]...)
+	cmd.Dir = workDir
+	cmd.Env = env
+	cmd.Stdin = h.stdin()
+	cmd.Stdout, cmd.Stderr = outputFrom(ctx)
+	return cmd.Run()
+}
+
+type outputKey struct{}
+
+// withOutput returns context with writer which will receive standard output and error of hooks.
+func withOutput(ctx context.Context, out io.Writer) context.Context {
+	return context.WithValue(ctx, outputKey{}, out)
+}
+
+// standard output and error of hooks: writer from context, or standard output and error of process.
+func outputFrom(ctx context.Context) (stdout, stderr io.Writer) {
+	if out, ok := ctx.Value(outputKey{}).(io.Writer); ok {
+		return out, out
+	}
+	return os.Stdout, os.Stderr
+}
+
+type destinationKey struct{}
+
+// withDestination returns context with destination directory for LAYOUT_DEST, if hooks are executed in another
+// directory (for example, in staging directory).
+func withDestination(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, destinationKey{}, dir)
+}
+
+// destination directory from context or work dir of hook.
+func destinationFrom(ctx context.Context, workDir string) string {
+	if dir, ok := ctx.Value(destinationKey{}).(string); ok {
+		return dir
 	}
-	if cp.Script != "" {
-		return cp.executeScript(ctx, renderContext, workDir, layoutFS)
+	return workDir
+}
+
+// standard input of hook, nil if not set.
+func (h Runnable) stdin() io.Reader {
+	if h.Stdin == "" {
+		return nil
 	}
-	return cp.executeInline(ctx, workDir)
+	return strings.NewReader(h.Stdin)
 }
 
 // execute inline (run) shell script.
-func (h Runnable) executeInline(ctx context.Context, workDir string) error {
+func (h Runnable) executeInline(ctx context.Context, workDir string, env []string) error {
 	script, err := syntax.NewParser().Parse(strings.NewReader(h.Run), "")
 	if err != nil {
 		return fmt.Errorf("parse script: %w", err)
 	}
 
-	runner, err := interp.New(interp.Dir(workDir), interp.StdIO(nil, os.Stdout, os.Stderr))
+	runner, err := h.newRunner(ctx, workDir, env)
 	if err != nil {
 		return fmt.Errorf("create script runner: %w", err)
 	}
@@ -56,9 +209,26 @@ func (h Runnable) executeInline(ctx context.Context, workDir string) error {
 	return runner.Run(ctx, script)
 }
 
+// shell runner with hook output. In restricted mode (sandbox in context), it can write files only in writable paths
+// and execute only allowed commands.
+func (h Runnable) newRunner(ctx context.Context, workDir string, env []string) (*interp.Runner, error) {
+	stdout, stderr := outputFrom(ctx)
+	options := []interp.RunnerOption{interp.Dir(workDir), interp.Env(expand.ListEnviron(env...)), interp.StdIO(h.stdin(), stdout, stderr)}
+	if sb := sandboxFrom(ctx); sb != nil {
+		options = append(options,
+			interp.ExecHandler(sb.execHandler(interp.DefaultExecHandler(2*time.Second))),
+			interp.OpenHandler(sb.openHandler(interp.DefaultOpenHandler())),
+		)
+	}
+	return interp.New(options...)
+}
+
 // render script to temporary file and execute it. Automatically sets +x (executable) flag to file.
 // It CAN support more or less complex shell execution, however, it designed for direct script invocation: <script> [args...]
-func (h Runnable) executeScript(ctx context.Context, renderContext *renderContext, workDir string, layoutFS string) error {
+func (h Runnable) executeScript(ctx context.Context, renderContext *renderContext, workDir string, layoutFS string, env []string) error {
+	if sandboxFrom(ctx) != nil {
+		return errors.New("script hooks are not allowed in restricted mode")
+	}
 	parsedCommand, err := syntax.NewParser().Parse(strings.NewReader(h.Script), "")
 	if err != nil {
 		return fmt.Errorf("parse script invokation: %w", err)
@@ -107,7 +277,7 @@ func (h Runnable) executeScript(ctx context.Context, renderContext *renderContex
 		callExpr.Args[0].Parts[0] = &syntax.Lit{Value: f.Name()}
 	}
 
-	runner, err := interp.New(interp.Dir(workDir), interp.StdIO(nil, os.Stdout, os.Stderr))
+	runner, err := h.newRunner(ctx, workDir, env)
 	if err != nil {
 		return fmt.Errorf("create script runner: %w", err)
 	}
@@ -115,7 +285,105 @@ func (h Runnable) executeScript(ctx context.Context, renderContext *renderContex
 	return runner.Run(ctx, parsedCommand)
 }
 
-// render templated variables: run, script
+// environment of hook: process environment, state variables (LAYOUT_VAR_<NAME>), paths, and custom variables
+// from hook definition (highest priority, the last definition of variable wins).
+func (h Runnable) environ(state map[string]interface{}, destination, layoutFS, stateFile string) ([]string, error) {
+	env := os.Environ()
+	for k, v := range state {
+		value, err := envValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("encode %s: %w", k, err)
+		}
+		env = append(env, EnvVarPrefix+envName(k)+"="+value)
+	}
+	env = append(env, EnvDest+"="+destination, EnvSource+"="+layoutFS, EnvStateFile+"="+stateFile)
+	var custom = make([]string, 0, len(h.Env))
+	for k, v := range h.Env {
+		custom = append(custom, k+"="+v)
+	}
+	sort.Strings(custom)
+	return append(env, custom...), nil
+}
+
+// name of variable in environment: upper case, non-alphanumeric characters replaced by underscore.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// value of variable in environment: strings as-is, lists and maps as JSON, everything else formatted.
+func envValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []string, []interface{}, map[string]interface{}:
+		data, err := json.Marshal(v)
+		return string(data), err
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// read variables exported by hook: JSON object or lines in KEY=value format (empty lines and lines started
+// by # are ignored). Empty file means nothing exported.
+func readOutput(file string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	content := strings.TrimSpace(string(data))
+	if strings.HasPrefix(content, "{") {
+		var values map[string]interface{}
+		return values, json.Unmarshal([]byte(content), &values)
+	}
+	var values = make(map[string]interface{})
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=value", i+1)
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	return values, nil
+}
+
+// create empty temporary file and return its name.
+func createTemp(pattern string) (string, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// save state as JSON to temporary file.
+func saveState(state map[string]interface{}) (string, error) {
+	f, err := os.CreateTemp("", "layout-state-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(state); err != nil {
+		_ = os.RemoveAll(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// render templated variables: run, script, exec, env, dir, stdin
 func (h Runnable) render(renderer *renderContext) (Runnable, error) {
 	if v, err := renderer.Render(h.Run); err != nil {
 		return h, fmt.Errorf("render run: %w", err)
@@ -127,11 +395,50 @@ func (h Runnable) render(renderer *renderContext) (Runnable, error) {
 	} else {
 		h.Script = v
 	}
+	env := make(map[string]string, len(h.Env))
+	for k, v := range h.Env {
+		if value, err := renderer.Render(v); err != nil {
+			return h, fmt.Errorf("render env %s: %w", k, err)
+		} else {
+			env[k] = value
+		}
+	}
+	h.Env = env
+	args := make([]string, 0, len(h.Exec))
+	for i, arg := range h.Exec {
+		if v, err := renderer.Render(arg); err != nil {
+			return h, fmt.Errorf("render exec argument #%d: %w", i, err)
+		} else {
+			args = append(args, v)
+		}
+	}
+	h.Exec = args
+	if v, err := renderer.Render(h.Dir); err != nil {
+		return h, fmt.Errorf("render dir: %w", err)
+	} else {
+		h.Dir = v
+	}
+	if v, err := renderer.Render(h.Stdin); err != nil {
+		return h, fmt.Errorf("render stdin: %w", err)
+	} else {
+		h.Stdin = v
+	}
+	if v, err := h.Action.render(renderer); err != nil {
+		return h, fmt.Errorf("render action: %w", err)
+	} else {
+		h.Action = v
+	}
 	return h, nil
 }
 
-// describe what will be executed: path to script or shell command
+// describe what will be executed: action with arguments, command, path to script or shell command
 func (h Runnable) what() string {
+	if len(h.defined()) > 0 {
+		return h.Action.describe()
+	}
+	if len(h.Exec) > 0 {
+		return strings.Join(h.Exec, " ")
+	}
 	if h.Script != "" {
 		return h.Script
 	}
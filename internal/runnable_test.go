@@ -17,14 +17,21 @@ limitations under the License.
 package internal
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/reddec/layout/internal/ui/simple"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 func TestRunnable(t *testing.T) {
@@ -87,6 +94,378 @@ echo -n "$1" > hook2.txt
 		require.FileExists(t, filepath.Join(tmpDir, "hook2.txt"))
 		requireContent(t, "123", filepath.Join(tmpDir, "hook2.txt"))
 	})
+
+	t.Run("state exported to environment", func(t *testing.T) {
+		env := map[string]interface{}{
+			"name":        `it's "quoted" $HOME`,
+			"my-features": []string{"a", "b"},
+			"count":       3,
+		}
+		run := Runnable{
+			Run: `printf '%s|%s|%s|%s|%s' "$LAYOUT_VAR_NAME" "$LAYOUT_VAR_MY_FEATURES" "$LAYOUT_VAR_COUNT" "$LAYOUT_SOURCE" "$CUSTOM" > env.txt
+cat "$LAYOUT_STATE_FILE" > state.json
+test "$LAYOUT_DEST" = "$PWD"`,
+			Env: map[string]string{"CUSTOM": "{{.count}}", "LAYOUT_SOURCE": "overridden"},
+		}
+		err := run.execute(ctx, newRenderContext(env), tmpDir, "/layout")
+		require.NoError(t, err)
+		requireContent(t, `it's "quoted" $HOME|["a","b"]|3|overridden|3`, filepath.Join(tmpDir, "env.txt"))
+		requireContent(t, `{"count":3,"my-features":["a","b"],"name":"it's \"quoted\" $HOME"}`+"\n", filepath.Join(tmpDir, "state.json"))
+	})
+
+	t.Run("exported variables saved to state", func(t *testing.T) {
+		state := map[string]interface{}{"foo": 123}
+		renderer := newRenderContext(state)
+
+		run := Runnable{Run: `echo "# comment" >> "$LAYOUT_OUTPUT"
+echo "version=1.2 = 3" >> "$LAYOUT_OUTPUT"
+echo "foo=bar" >> "$LAYOUT_OUTPUT"`}
+		require.NoError(t, run.execute(ctx, renderer, tmpDir, ""))
+		require.Equal(t, "1.2 = 3", state["version"])
+		require.Equal(t, "bar", state["foo"])
+
+		run = Runnable{Run: `echo '{"tags": ["v1", "v2"], "count": 2}' > "$LAYOUT_OUTPUT"`}
+		require.NoError(t, run.execute(ctx, renderer, tmpDir, ""))
+		require.Equal(t, []interface{}{"v1", "v2"}, state["tags"])
+		require.Equal(t, float64(2), state["count"])
+
+		run = Runnable{Run: `echo "broken" > "$LAYOUT_OUTPUT"`}
+		require.Error(t, run.execute(ctx, renderer, tmpDir, ""))
+	})
+}
+
+func TestRunnableExec(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "sub"), 0755))
+
+	ctx := context.Background()
+	renderer := newRenderContext(map[string]interface{}{"name": "it's me"})
+
+	t.Run("exec with args, env, dir and stdin", func(t *testing.T) {
+		run := Runnable{
+			Exec:  []string{"sh", "-c", `cat > exec.txt; echo -n " $1 $GREETING" >> exec.txt`, "sh", "{{.name}}"},
+			Env:   map[string]string{"GREETING": "hello"},
+			Dir:   "sub",
+			Stdin: "input",
+		}
+		require.NoError(t, run.execute(ctx, renderer, tmpDir, ""))
+		requireContent(t, "input it's me hello", filepath.Join(tmpDir, "sub", "exec.txt"))
+	})
+
+	t.Run("destination is not affected by dir", func(t *testing.T) {
+		run := Runnable{Run: `echo -n "$LAYOUT_DEST" > dest.txt`, Dir: "sub"}
+		require.NoError(t, run.execute(ctx, renderer, tmpDir, ""))
+		requireContent(t, tmpDir, filepath.Join(tmpDir, "sub", "dest.txt"))
+	})
+
+	t.Run("stdin for inline", func(t *testing.T) {
+		run := Runnable{Run: "cat > inline-stdin.txt", Stdin: "{{.name}}"}
+		require.NoError(t, run.execute(ctx, renderer, tmpDir, ""))
+		requireContent(t, "it's me", filepath.Join(tmpDir, "inline-stdin.txt"))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		run := Runnable{Exec: []string{"sleep", "5"}, Timeout: 100 * time.Millisecond}
+		started := time.Now()
+		err := run.execute(ctx, renderer, tmpDir, "")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "timeout")
+		require.Less(t, time.Since(started), 5*time.Second)
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		run := Runnable{Run: `echo x >> attempts.txt; test "$(wc -l < attempts.txt)" -ge 3`, Retries: 2}
+		require.NoError(t, run.execute(ctx, renderer, tmpDir, ""))
+		requireContent(t, "x\nx\nx\n", filepath.Join(tmpDir, "attempts.txt"))
+
+		run = Runnable{Exec: []string{"false"}, Retries: 1}
+		require.Error(t, run.execute(ctx, renderer, tmpDir, ""))
+	})
+
+	t.Run("ignore error", func(t *testing.T) {
+		run := Runnable{Exec: []string{"sh", "-c", `echo "ok=yes" > "$LAYOUT_OUTPUT"; exit 1`}, IgnoreError: true}
+		require.NoError(t, run.execute(ctx, renderer, tmpDir, ""))
+		require.Equal(t, "yes", renderer.State()["ok"])
+	})
+
+	t.Run("from manifest", func(t *testing.T) {
+		var hooks []Hook
+		require.NoError(t, yaml.Unmarshal([]byte(`
+- exec: [npm, install]
+  dir: web
+  timeout: 2m
+  retries: 3
+  ignore_error: true
+`), &hooks))
+		require.Equal(t, Runnable{
+			Exec:        []string{"npm", "install"},
+			Dir:         "web",
+			Timeout:     2 * time.Minute,
+			Retries:     3,
+			IgnoreError: true,
+		}, hooks[0].Runnable)
+	})
+}
+
+func TestHookExport(t *testing.T) {
+	source := createDir(map[string]string{
+		"layout.yaml": `
+before:
+  - run: echo "greeting=hello" > "$LAYOUT_OUTPUT"
+  - run: echo "target={{.greeting}} world" > "$LAYOUT_OUTPUT"
+`,
+		"content/{{.greeting}}.txt": "{{.target}}",
+	})
+	defer os.RemoveAll(source)
+
+	dest, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	err = Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true})
+	require.NoError(t, err)
+	requireContent(t, "hello world", filepath.Join(dest, "hello.txt"))
+}
+
+func TestHookStages(t *testing.T) {
+	t.Run("init and post_prompt run before content", func(t *testing.T) {
+		source := createDir(map[string]string{
+			"layout.yaml": `
+init:
+  - run: echo "detected=linux" > "$LAYOUT_OUTPUT"
+prompts:
+  - var: os
+    default: "{{.detected}}"
+post_prompt:
+  - run: echo -n "{{.os}}" > post-prompt.log
+`,
+			"content/os.txt": "{{.os}}",
+		})
+		defer os.RemoveAll(source)
+
+		tmpDir, err := os.MkdirTemp("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(tmpDir)
+		dest := filepath.Join(tmpDir, "project")
+
+		err = Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true, Display: &defaultsUI{}})
+		require.NoError(t, err)
+		requireContent(t, "linux", filepath.Join(dest, "os.txt"))
+		requireContent(t, "linux", filepath.Join(tmpDir, "post-prompt.log"))
+	})
+
+	t.Run("on_error and finally", func(t *testing.T) {
+		source := createDir(map[string]string{
+			"layout.yaml": `
+after:
+  - run: exit 3
+on_error:
+  - run: echo -n "{{.error}}" > error.txt
+  - run: echo -n "$LAYOUT_VAR_ERROR" > env-error.txt
+finally:
+  - run: echo -n done > finally.txt
+`,
+			"content/README.md": "readme",
+		})
+		defer os.RemoveAll(source)
+
+		dest, err := os.MkdirTemp("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		err = Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "execute post-generate hook #0")
+		requireContent(t, "execute post-generate hook #0 (exit 3): exit status 3", filepath.Join(dest, "error.txt"))
+		requireContent(t, "execute post-generate hook #0 (exit 3): exit status 3", filepath.Join(dest, "env-error.txt"))
+		requireContent(t, "done", filepath.Join(dest, "finally.txt"))
+	})
+
+	t.Run("on_error never executed outside of new destination", func(t *testing.T) {
+		for _, stage := range []string{"post_prompt", "before", "after"} {
+			t.Run(stage, func(t *testing.T) {
+				source := createDir(map[string]string{
+					"layout.yaml": stage + `:
+  - run: exit 1
+on_error:
+  - run: echo -n "$PWD" > "$LAYOUT_VAR_MARKER"
+finally:
+  - run: touch finally.txt
+`,
+					"content/README.md": "readme",
+				})
+				defer os.RemoveAll(source)
+
+				tmpDir := t.TempDir()
+				dest := filepath.Join(tmpDir, "project")
+				marker := filepath.Join(t.TempDir(), "marker")
+
+				err := Deploy(context.Background(), Config{
+					Source:   source,
+					Target:   dest,
+					AskOnce:  true,
+					Defaults: map[string]interface{}{"marker": marker},
+				})
+				require.Error(t, err)
+				require.NoDirExists(t, dest)
+				entries, err := os.ReadDir(tmpDir)
+				require.NoError(t, err)
+				require.Empty(t, entries, "nothing should be left in parent directory")
+
+				switch stage {
+				case "post_prompt":
+					require.NoFileExists(t, marker)
+				case "before":
+					cwd, err := os.ReadFile(marker)
+					require.NoError(t, err)
+					require.Equal(t, tmpDir, filepath.Dir(string(cwd)))
+					require.True(t, strings.HasPrefix(filepath.Base(string(cwd)), ".project"+stagingPrefix))
+				case "after":
+					requireContent(t, dest, marker)
+				}
+			})
+		}
+	})
+
+	t.Run("finally without error", func(t *testing.T) {
+		source := createDir(map[string]string{
+			"layout.yaml": `
+on_error:
+  - run: touch error.txt
+finally:
+  - run: echo -n done > finally.txt
+`,
+			"content/README.md": "readme",
+		})
+		defer os.RemoveAll(source)
+
+		dest, err := os.MkdirTemp("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		err = Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true})
+		require.NoError(t, err)
+		require.NoFileExists(t, filepath.Join(dest, "error.txt"))
+		requireContent(t, "done", filepath.Join(dest, "finally.txt"))
+	})
+}
+
+func TestHookOutput(t *testing.T) {
+	source := createDir(map[string]string{
+		"layout.yaml": `
+prompts:
+  - var: fail
+after:
+  - label: Greet
+    run: echo hello; echo oops >&2
+  - run: echo "{{.fail}}"; test "{{.fail}}" != "yes"
+`,
+		"content/README.md": "readme",
+	})
+	defer os.RemoveAll(source)
+
+	dest, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	t.Run("output shown in UI and saved to log", func(t *testing.T) {
+		var out bytes.Buffer
+		logFile := filepath.Join(dest, "hooks.log")
+		err := Deploy(context.Background(), Config{
+			Source:   source,
+			Target:   dest,
+			AskOnce:  true,
+			Answers:  map[string]interface{}{"fail": "no"},
+			Display:  simple.New(bufio.NewReader(strings.NewReader("")), &out),
+			HooksLog: logFile,
+		})
+		require.NoError(t, err)
+		require.Contains(t, out.String(), "[info] Greet\nhello\noops\n")
+		requireContent(t, "# echo hello; echo oops >&2\nhello\noops\n# echo \"{{.fail}}\"; test \"{{.fail}}\" != \"yes\"\nno\n", logFile)
+	})
+
+	t.Run("temporary log kept on failure", func(t *testing.T) {
+		err := Deploy(context.Background(), Config{
+			Source:  source,
+			Target:  dest,
+			AskOnce: true,
+			Answers: map[string]interface{}{"fail": "yes"},
+			Display: simple.New(bufio.NewReader(strings.NewReader("")), io.Discard),
+		})
+		require.Error(t, err)
+		_, logFile, ok := strings.Cut(strings.TrimSuffix(err.Error(), ")"), "hooks output saved to ")
+		require.True(t, ok, err.Error())
+		defer os.RemoveAll(logFile)
+		d, err := os.ReadFile(logFile)
+		require.NoError(t, err)
+		require.Contains(t, string(d), "hello\noops\n")
+		require.Contains(t, string(d), "yes\n")
+	})
+
+	t.Run("failed close of log reported", func(t *testing.T) {
+		hr := &hooksRunner{logFile: filepath.Join(t.TempDir(), "hooks.log")}
+		require.NoError(t, hr.openLog())
+		require.NoError(t, hr.log.Close()) // the next close fails
+
+		err := hr.close(nil)
+		require.ErrorContains(t, err, "close hooks log file")
+
+		err = hr.close(errors.New("generation failed"))
+		require.ErrorContains(t, err, "generation failed (also close hooks log file")
+		require.ErrorContains(t, err, "hooks output saved to")
+	})
+}
+
+func TestParallelHooks(t *testing.T) {
+	deploy := func(t *testing.T, manifest string) (string, error) {
+		source := createDir(map[string]string{
+			"layout.yaml":       manifest,
+			"content/README.md": "{{.first}}-{{.second}}",
+		})
+		t.Cleanup(func() { _ = os.RemoveAll(source) })
+		dest, err := os.MkdirTemp("", "")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = os.RemoveAll(dest) })
+		return dest, Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true})
+	}
+
+	t.Run("group executed concurrently", func(t *testing.T) {
+		// each hook waits for the file created by another one, so sequential execution will time out
+		dest, err := deploy(t, `
+before:
+  - parallel: deps
+    run: touch a.txt; while [ ! -f b.txt ]; do sleep 0.05; done; echo "first=1" > "$LAYOUT_OUTPUT"
+    timeout: 5s
+  - parallel: deps
+    run: touch b.txt; while [ ! -f a.txt ]; do sleep 0.05; done; echo "second=2" > "$LAYOUT_OUTPUT"
+    timeout: 5s
+  - parallel: deps
+    run: exit 1
+    when: "false"
+  - run: echo -n "{{.first}}{{.second}}" > after.txt
+`)
+		require.NoError(t, err)
+		requireContent(t, "1-2", filepath.Join(dest, "README.md"))
+		requireContent(t, "12", filepath.Join(dest, "after.txt"))
+	})
+
+	t.Run("first failure cancels group", func(t *testing.T) {
+		started := time.Now()
+		dest, err := deploy(t, `
+after:
+  - parallel: deps
+    exec: [sleep, "10"]
+  - parallel: deps
+    run: exit 3
+  - run: touch never.txt
+`)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "execute post-generate hook #1 (exit 3)")
+		require.Less(t, time.Since(started), 5*time.Second)
+		require.NoFileExists(t, filepath.Join(dest, "never.txt"))
+	})
 }
 
 func requireContent(t *testing.T, expected string, fileName string) {
@@ -0,0 +1,166 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib"
+)
+
+const LayoutModule = "layout" // name of Tengo module with layout helpers
+
+const scriptResult = "__res__" // name of variable with result of expression or script
+
+// standard Tengo modules available for import in scripts. OS module excluded intentionally.
+var tengoStdlib = []string{"text", "fmt", "json", "math", "times", "rand", "base64", "hex", "enum"}
+
+// evalExpr evaluates Tengo expression with state and helpers and returns result as Go value.
+func evalExpr(ctx context.Context, expr string, state map[string]interface{}) (interface{}, error) {
+	return runScript(ctx, fmt.Sprintf("%s := (%s)", scriptResult, strings.TrimSpace(expr)), state)
+}
+
+// evalScript runs Tengo program with state and helpers and returns value from top-level return statement
+// (undefined if nothing returned) as Go value.
+func evalScript(ctx context.Context, program string, state map[string]interface{}) (interface{}, error) {
+	return runScript(ctx, fmt.Sprintf("%s := func() {\n%s\n}()", scriptResult, program), state)
+}
+
+// run source with state as variables, helpers, and available modules. Returns value of result variable.
+func runScript(ctx context.Context, source string, state map[string]interface{}) (interface{}, error) {
+	script := tengo.NewScript([]byte(source))
+	for pk, pv := range sanitizeState(state) {
+		err := script.Add(pk, pv)
+		if err != nil {
+			return nil, fmt.Errorf("script add: %w", err)
+		}
+	}
+	// helpers
+	if err := script.Add("has", hasHelper); err != nil {
+		return nil, fmt.Errorf("add 'has' helper: %w", err)
+	}
+	h := helpersFrom(ctx)
+	for name, fn := range h.tengoFuncs() {
+		if _, ok := state[name]; ok {
+			continue // state has priority, helper is still available in layout module
+		}
+		if err := script.Add(name, fn); err != nil {
+			return nil, fmt.Errorf("add '%s' helper: %w", name, err)
+		}
+	}
+	script.SetImports(h.tengoModules())
+	if _, ok := state[LayoutModule]; !ok {
+		// module pre-imported for short access in expressions, state has priority
+		if err := script.Add(LayoutModule, &tengo.ImmutableMap{Value: h.tengoModule()}); err != nil {
+			return nil, fmt.Errorf("add '%s' module: %w", LayoutModule, err)
+		}
+	}
+
+	compiled, err := script.RunContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("script run: %w", err)
+	}
+	return compiled.Get(scriptResult).Value(), nil
+}
+
+// tengoModules returns modules which can be imported in scripts: curated stdlib, strings (alias of text),
+// and layout module with helpers.
+func (h helpers) tengoModules() *tengo.ModuleMap {
+	modules := stdlib.GetModuleMap(tengoStdlib...)
+	modules.AddBuiltinModule("strings", stdlib.BuiltinModules["text"])
+	modules.AddBuiltinModule(LayoutModule, h.tengoModule())
+	return modules
+}
+
+// tengoModule is the layout module: scaffolding helpers, file lookups, regex and semver helpers.
+// File lookups return error value (falsy) instead of failing the script if nothing found.
+func (h helpers) tengoModule() map[string]tengo.Object {
+	module := h.tengoFuncs()
+	softFuncs := map[string]interface{}{
+		"getRootFile":  getRootFile(h.workDir),
+		"findRootFile": findRootFile(h.workDir),
+		"findRootDir":  findRootDir(h.workDir),
+	}
+	for name, fn := range softFuncs {
+		module[name] = &tengo.UserFunction{Name: name, Value: softErrors(tengoAdapter(fn))}
+	}
+	strictFuncs := map[string]interface{}{
+		"findSubmatch":  findSubmatchAll,
+		"regexMatch":    regexMatch,
+		"regexReplace":  regexReplace,
+		"semverCompare": semverCompare,
+		"semverCmp":     semverCmp,
+	}
+	for name, fn := range strictFuncs {
+		module[name] = &tengo.UserFunction{Name: name, Value: tengoAdapter(fn)}
+	}
+	return module
+}
+
+// converts returned errors to Tengo error values.
+func softErrors(fn tengo.CallableFunc) tengo.CallableFunc {
+	return func(args ...tengo.Object) (tengo.Object, error) {
+		ret, err := fn(args...)
+		if err != nil {
+			return &tengo.Error{Value: &tengo.String{Value: err.Error()}}, nil
+		}
+		return ret, nil
+	}
+}
+
+func regexMatch(pattern string, text string) (bool, error) {
+	return regexp.MatchString(pattern, text)
+}
+
+func regexReplace(pattern string, text string, replacement string) (string, error) {
+	p, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return p.ReplaceAllString(text, replacement), nil
+}
+
+// semverCompare returns true if version satisfies constraint (ex: >= 1.2, ~1).
+func semverCompare(constraint string, version string) (bool, error) {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return false, err
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return false, err
+	}
+	return c.Check(v), nil
+}
+
+// semverCmp compares two versions and returns -1, 0, or 1.
+func semverCmp(a string, b string) (int, error) {
+	va, err := semver.NewVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := semver.NewVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	return va.Compare(vb), nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayoutModule(t *testing.T) {
+	dir := createDir(map[string]string{
+		"go.mod":     "module example.com/foo\n",
+		"sub/a.txt":  "",
+		"sub/b/.tpl": "",
+	})
+	defer os.RemoveAll(dir)
+
+	ctx := withWorkDir(context.Background(), filepath.Join(dir, "sub"))
+	state := map[string]interface{}{"name": "my-app", "version": "1.4.2"}
+
+	cases := map[string]bool{
+		`layout.findRootFile("go.mod") != ""`:                       true,
+		`is_error(layout.findRootFile("Cargo.toml"))`:               true,
+		`!layout.findRootFile("Cargo.toml")`:                        true,
+		`layout.semverCompare(">= 1.2, < 2", version)`:              true,
+		`layout.semverCmp(version, "1.10.0") < 0`:                   true,
+		`layout.regexMatch("^my-", name)`:                           true,
+		`layout.regexReplace("-", name, "_") == "my_app"`:           true,
+		`layout.findSubmatch("(\\w+)-", name)[0] == "my"`:           true,
+		`layout.screamingSnake(name) == "MY_APP"`:                   true,
+		`import("text").contains(name, "app")`:                      true,
+		`import("strings").to_upper(name) == "MY-APP"`:              true,
+		`import("json").encode({a: 1}) == bytes("{\"a\":1}")`:       true,
+		`import("fmt").sprintf("%s@%s", name, version) == "my-app"`: false,
+		`import("layout").goModulePath() == "example.com/foo"`:      true,
+	}
+	for expr, expected := range cases {
+		ok, err := Condition(expr).Eval(ctx, state)
+		require.NoError(t, err, expr)
+		assert.Equal(t, expected, ok, expr)
+	}
+
+	t.Run("os module is not available", func(t *testing.T) {
+		_, err := Condition(`import("os").getenv("HOME") != ""`).Eval(ctx, state)
+		require.Error(t, err)
+	})
+
+	t.Run("state has priority", func(t *testing.T) {
+		ok, err := Condition(`layout == "foo"`).Eval(ctx, map[string]interface{}{"layout": "foo"})
+		require.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("state has priority over helpers", func(t *testing.T) {
+		ok, err := Condition(`kebabCase == "foo" && layout.kebabCase("Foo Bar") == "foo-bar"`).Eval(ctx, map[string]interface{}{"kebabCase": "foo"})
+		require.NoError(t, err)
+		assert.True(t, ok)
+	})
+}
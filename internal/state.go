@@ -24,7 +24,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
 
 	"github.com/reddec/layout/internal/ui"
 
@@ -33,7 +32,9 @@ import (
 )
 
 // Ask questions to user and generate state. Base file initially equal to manifest file and used to resolve relative includes.
-func askState(ctx context.Context, display ui.UI, prompts []Prompt, baseFile string, layoutDir string, renderContext *renderContext, once bool) error {
+// Prompts which variables are defined in answers will not be asked: string answers are parsed according to prompt type,
+// other values are used as-is.
+func askState(ctx context.Context, display ui.UI, prompts []Prompt, baseFile string, layoutDir string, renderContext *renderContext, once bool, answers map[string]interface{}) error {
 	for i, prompt := range prompts {
 		if ctx.Err() != nil {
 			return ctx.Err()
@@ -62,12 +63,22 @@ func askState(ctx context.Context, display ui.UI, prompts []Prompt, baseFile str
 			if err != nil {
 				return fmt.Errorf("step %d, file %s, include %s: %w", i, baseFile, prompt.Include, err)
 			}
-			if err := askState(ctx, display, children, childFile, layoutDir, renderContext, once); err != nil {
+			if err := askState(ctx, display, children, childFile, layoutDir, renderContext, once, answers); err != nil {
 				return fmt.Errorf("step %d, file %s, process include %s: %w", i, baseFile, prompt.Include, err)
 			}
 			continue
 		}
 
+		// pre-defined answer has priority over user input
+		if answer, ok := answers[prompt.Var]; ok {
+			value, err := prompt.answer(answer)
+			if err != nil {
+				return fmt.Errorf("use answer for %s (step %d) in %s: %w", prompt.Var, i, baseFile, err)
+			}
+			renderContext.Save(prompt.Var, value)
+			continue
+		}
+
 		// in case of failed user input we will retry again and again till Stdin or context closed
 		for {
 			value, err := prompt.ask(ctx, display)
@@ -96,24 +107,10 @@ func (p Condition) Eval(ctx context.Context, state map[string]interface{}) (bool
 	if p == "" {
 		return false, nil
 	}
-	expr := strings.TrimSpace(string(p))
-	script := tengo.NewScript([]byte(fmt.Sprintf("__res__ := (%s)", expr)))
-	for pk, pv := range sanitizeState(state) {
-		err := script.Add(pk, pv)
-		if err != nil {
-			return false, fmt.Errorf("script add: %w", err)
-		}
-	}
-	// helpers
-	if err := script.Add("has", hasHelper); err != nil {
-		return false, fmt.Errorf("add 'has' helper: %w", err)
-	}
-
-	compiled, err := script.RunContext(ctx)
+	res, err := evalExpr(ctx, string(p), state)
 	if err != nil {
-		return false, fmt.Errorf("script run: %w", err)
+		return false, err
 	}
-	res := compiled.Get("__res__").Value()
 	if v, ok := res.(bool); ok {
 		return v, nil
 	}
@@ -52,7 +52,7 @@ func TestAsk(t *testing.T) {
 			{Var: "free-list", Type: VarList},
 		}
 		state := make(map[string]interface{})
-		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true)
+		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true, nil)
 		require.NoError(t, err)
 
 		for k, v := range expected {
@@ -73,7 +73,7 @@ func TestAsk(t *testing.T) {
 			{Var: "int", Type: VarInt, Default: "123"},
 		}
 		state := make(map[string]interface{})
-		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true)
+		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true, nil)
 		require.NoError(t, err)
 
 		for k, v := range expected {
@@ -91,7 +91,7 @@ func TestAsk(t *testing.T) {
 			{Var: "string", Type: VarString, Options: []string{"abc", "def"}},
 		}
 		state := make(map[string]interface{})
-		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true)
+		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true, nil)
 		require.Error(t, err)
 	})
 
@@ -104,7 +104,7 @@ func TestAsk(t *testing.T) {
 			{Var: "string", Type: VarString, Options: []string{"abc", "def"}},
 		}
 		state := make(map[string]interface{})
-		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true)
+		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true, nil)
 		require.NoError(t, err)
 
 		for k, v := range expected {
@@ -127,7 +127,7 @@ func TestAsk(t *testing.T) {
 			{Var: "templated", Type: VarString, Default: "abc {{.string}}"},
 		}
 		state := make(map[string]interface{})
-		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true)
+		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true, nil)
 		require.NoError(t, err)
 
 		for k, v := range expected {
@@ -149,7 +149,7 @@ func TestAsk(t *testing.T) {
 			{Var: "skipped", Type: VarString, When: "foo < 100"},
 		}
 		state := make(map[string]interface{})
-		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true)
+		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true, nil)
 		require.NoError(t, err)
 
 		for k, v := range expected {
@@ -172,7 +172,7 @@ func TestAsk(t *testing.T) {
 			{Var: "skipped", Type: VarString, When: "foo < 100"},
 		}
 		state := make(map[string]interface{})
-		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true)
+		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), true, nil)
 		require.NoError(t, err)
 
 		for k, v := range expected {
@@ -210,7 +210,7 @@ func TestAsk(t *testing.T) {
 			{Include: "dir/xxx.yaml"},
 		}
 		state := make(map[string]interface{})
-		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", source, newRenderContext(state), true)
+		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", source, newRenderContext(state), true, nil)
 		require.NoError(t, err)
 
 		for k, v := range expected {
@@ -231,7 +231,7 @@ func TestAsk(t *testing.T) {
 			{Var: "foo", Type: VarInt},
 		}
 		state := make(map[string]interface{})
-		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), false)
+		err := askState(context.Background(), simple.New(bufio.NewReader(input), io.Discard), prompts, "", "", newRenderContext(state), false, nil)
 		require.NoError(t, err)
 
 		for k, v := range expected {
@@ -280,6 +280,54 @@ func TestComputed(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, 123456, state["foo"])
 	})
+
+	t.Run("expression result stored with native type", func(t *testing.T) {
+		c := Computed{
+			Var:  "foo",
+			Expr: `{name: name, ports: [80, 443], count: len(features)}`,
+		}
+		state := map[string]interface{}{"name": "alice", "features": []string{"http", "ui"}}
+		err := c.compute(context.Background(), newRenderContext(state))
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{
+			"name":  "alice",
+			"ports": []interface{}{int64(80), int64(443)},
+			"count": int64(2),
+		}, state["foo"])
+	})
+
+	t.Run("script returns value", func(t *testing.T) {
+		c := Computed{
+			Var:  "foo",
+			Type: VarList,
+			Script: `
+text := import("text")
+out := []
+for f in features {
+  if text.has_prefix(f, "h") { out = append(out, text.to_upper(f)) }
+}
+return out
+`,
+		}
+		state := map[string]interface{}{"features": []string{"http", "ui", "html"}}
+		err := c.compute(context.Background(), newRenderContext(state))
+		require.NoError(t, err)
+		require.Equal(t, []string{"HTTP", "HTML"}, state["foo"])
+	})
+
+	t.Run("default with expression", func(t *testing.T) {
+		d := Default{Var: "port", Expr: `8000 + 80`}
+		state := make(map[string]interface{})
+		err := d.compute(context.Background(), newRenderContext(state))
+		require.NoError(t, err)
+		require.Equal(t, int64(8080), state["port"])
+	})
+
+	t.Run("script error", func(t *testing.T) {
+		c := Computed{Var: "foo", Script: `return unknown + 1`}
+		err := c.compute(context.Background(), newRenderContext(map[string]interface{}{}))
+		require.Error(t, err)
+	})
 }
 
 func TestCondition_Eval(t *testing.T) {
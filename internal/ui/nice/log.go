@@ -0,0 +1,176 @@
+/*
+Copyright 2022 Aleksandr Baryshnikov
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/AlecAivazis/survey/v2/core"
+	"github.com/reddec/layout/internal/ui"
+	"golang.org/x/term"
+)
+
+const tailSize = 5 // number of last lines of output shown during operation
+
+// Output shows name (if set) of operation and last lines of output during operation. Full output is shown only in
+// case of failure. If stdout is not a terminal, output streamed as-is after name.
+func (ui *UI) Output(ctx context.Context, name string) (ui.Log, error) {
+	fd := int(os.Stdout.Fd())
+	if !term.IsTerminal(fd) {
+		if name != "" {
+			if err := ui.Info(ctx, name); err != nil {
+				return nil, err
+			}
+		}
+		return &streamLog{out: os.Stdout}, nil
+	}
+	width, _, err := term.GetSize(fd)
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	tl := &tailLog{name: name, out: os.Stdout, width: width}
+	return tl, tl.redraw()
+}
+
+type tailLog struct {
+	lock  sync.Mutex
+	name  string
+	out   io.Writer
+	width int
+	full  bytes.Buffer
+	tail  []string // last complete lines
+	line  []byte   // current (incomplete) line
+	drawn int      // number of lines drawn on screen
+}
+
+func (tl *tailLog) Write(p []byte) (int, error) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	tl.full.Write(p)
+	for _, c := range p {
+		if c != '\n' {
+			tl.line = append(tl.line, c)
+			continue
+		}
+		tl.tail = append(tl.tail, string(tl.line))
+		tl.line = tl.line[:0]
+		if len(tl.tail) > tailSize {
+			tl.tail = tl.tail[1:]
+		}
+	}
+	return len(p), tl.redraw()
+}
+
+func (tl *tailLog) Done(result error) error {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	if err := tl.clear(); err != nil {
+		return err
+	}
+	if result == nil {
+		if tl.name == "" {
+			return nil
+		}
+		return printTemplate(`{{color "green"}}✓ {{ . }}{{color "reset"}}`, tl.name)
+	}
+	if err := printTemplate(`{{color "red"}}X {{ . }}{{color "reset"}}`, tl.title()); err != nil {
+		return err
+	}
+	_, err := tl.out.Write(tl.full.Bytes())
+	return wrapErr(err)
+}
+
+// redraw header and last lines of output. Must be called under lock.
+func (tl *tailLog) redraw() error {
+	if err := tl.clear(); err != nil {
+		return err
+	}
+	lines := tl.tail
+	if len(tl.line) > 0 {
+		lines = append(lines[:len(lines):len(lines)], string(tl.line))
+		if len(lines) > tailSize {
+			lines = lines[1:]
+		}
+	}
+	var buf strings.Builder
+	buf.WriteString("\x1b[36m… " + tl.fit(tl.title()) + "\x1b[0m\n")
+	for _, line := range lines {
+		buf.WriteString("\x1b[2m  " + tl.fit(line) + "\x1b[0m\n")
+	}
+	tl.drawn = 1 + len(lines)
+	_, err := io.WriteString(tl.out, buf.String())
+	return wrapErr(err)
+}
+
+func (tl *tailLog) title() string {
+	if tl.name == "" {
+		return "running hook"
+	}
+	return tl.name
+}
+
+// clear previously drawn lines. Must be called under lock.
+func (tl *tailLog) clear() error {
+	if tl.drawn == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(tl.out, "\x1b[%dA\x1b[J", tl.drawn)
+	tl.drawn = 0
+	return wrapErr(err)
+}
+
+// keep only last carriage-returned segment (progress bars) and cut line to fit terminal width.
+func (tl *tailLog) fit(line string) string {
+	if idx := strings.LastIndexByte(strings.TrimRight(line, "\r"), '\r'); idx != -1 {
+		line = line[idx+1:]
+	}
+	line = strings.TrimRight(line, "\r")
+	limit := tl.width - 3
+	if limit < 1 || utf8.RuneCountInString(line) <= limit {
+		return line
+	}
+	return string([]rune(line)[:limit-1]) + "…"
+}
+
+type streamLog struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+func (sl *streamLog) Write(p []byte) (int, error) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	return sl.out.Write(p)
+}
+
+func (sl *streamLog) Done(error) error { return nil }
+
+func printTemplate(tpl string, data interface{}) error {
+	actual, _, err := core.RunTemplate(tpl, data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(actual)
+	return wrapErr(err)
+}
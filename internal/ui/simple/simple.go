@@ -25,6 +25,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/reddec/layout/internal/ui"
 )
@@ -164,6 +165,16 @@ func (ui *UI) Info(_ context.Context, message string) error {
 	return ui.print("[info] ", message, "\n")
 }
 
+// Output shows name (if set) as information message and streams output as-is.
+func (ui *UI) Output(ctx context.Context, name string) (ui.Log, error) {
+	if name != "" {
+		if err := ui.Info(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	return &streamLog{out: ui.out}, nil
+}
+
 func (ui *UI) print(data ...interface{}) error {
 	_, err := fmt.Fprint(ui.out, data...)
 	return err
@@ -242,3 +253,16 @@ func wrapErr(err error) error {
 	}
 	return err
 }
+
+type streamLog struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+func (sl *streamLog) Write(p []byte) (int, error) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	return sl.out.Write(p)
+}
+
+func (sl *streamLog) Done(error) error { return nil }
@@ -19,6 +19,7 @@ package ui
 import (
 	"context"
 	"errors"
+	"io"
 )
 
 type Dialog interface {
@@ -40,6 +41,15 @@ type UI interface {
 	Title(ctx context.Context, message string) error
 	// Info shows information message
 	Info(ctx context.Context, message string) error
+	// Output starts showing output (stdout and stderr) of long-running operation, such as hook, with provided name.
+	Output(ctx context.Context, name string) (Log, error)
+}
+
+// Log receives output of long-running operation. It should be safe for concurrent writes.
+type Log interface {
+	io.Writer
+	// Done marks operation as finished with result (nil means success). UI may show full output in case of failure.
+	Done(result error) error
 }
 
 // ErrInterrupted must be returned when user interrupted operation
@@ -136,8 +136,9 @@ func TestRender_gitClone(t *testing.T) {
 
 	// wooh - finally we initialized bare repo which we can clone
 	err = internal.Deploy(context.Background(), internal.Config{
-		Source: "file://" + tempDir,
-		Target: resultDir,
+		Source:  "file://" + tempDir,
+		Target:  resultDir,
+		Trusted: []string{"file://" + tempDir},
 		Display: simple.New(bufio.NewReader(strings.NewReader(
 			"alice\n1234\n3\nn\n1\n",
 		)), io.Discard),
@@ -187,3 +188,49 @@ func TestRender_multiProject(t *testing.T) {
 
 	})
 }
+
+func TestLayoutTest(t *testing.T) {
+	t.Run("golden directory matches", func(t *testing.T) {
+		results, err := internal.Test(context.Background(), internal.TestConfig{
+			Source: "test-data/projectA",
+		})
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, "basic", results[0].Name)
+		assert.True(t, results[0].Ok(), "%v %v", results[0].Err, results[0].Differences)
+	})
+
+	t.Run("difference detected and updated", func(t *testing.T) {
+		layoutDir, err := os.MkdirTemp("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(layoutDir)
+
+		_, err = internal.CopyTree("test-data/projectA", layoutDir)
+		require.NoError(t, err)
+
+		golden := filepath.Join(layoutDir, "tests", "basic", "expected", "root.text")
+		require.NoError(t, ioutil.WriteFile(golden, []byte("something else"), 0755))
+
+		results, err := internal.Test(context.Background(), internal.TestConfig{
+			Source: layoutDir,
+		})
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		require.NoError(t, results[0].Err)
+		require.Len(t, results[0].Differences, 1)
+		assert.Contains(t, results[0].Differences[0], "root.text")
+
+		_, err = internal.Test(context.Background(), internal.TestConfig{
+			Source: layoutDir,
+			Update: true,
+		})
+		require.NoError(t, err)
+		requireContent(t, "the foo", golden)
+	})
+}
+
+func requireContent(t *testing.T, expected string, fileName string) {
+	d, err := ioutil.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(bytes.TrimSpace(d)))
+}